@@ -0,0 +1,242 @@
+package shardedkv
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when a request is rejected by admission control
+// because the store is saturated.  It is classified as ErrRejected.
+var ErrOverloaded = NewError(ErrRejected, errors.New("shardedkv: store overloaded"))
+
+// Priority is the importance of a request to admission control
+type Priority int
+
+const (
+	// PriorityHigh requests may use the whole concurrency limit
+	PriorityHigh Priority = iota
+	// PriorityNormal is the priority of reads made directly on a KVStore
+	PriorityNormal
+	// PriorityLow is the priority of writes made directly on a KVStore, and
+	// of background work, which is shed first.  Use WithPriority to send
+	// writes with a higher priority.
+	PriorityLow
+)
+
+// AdmissionPolicy configures admission control for a KVStore.
+//
+// The store tracks the number of Get, Set and Delete requests in flight and
+// rejects new ones with ErrOverloaded once a concurrency limit is reached.
+// The limit adapts to observed latency: it grows slowly while requests
+// complete within TargetLatency, and shrinks by Backoff, at most once per
+// Window, when they don't.  Only successful requests which found their key
+// are measured, as errors and misses are often much faster than real work.
+// Lower priority requests are only admitted while the number in flight is
+// below their share of the limit, so they are shed before higher priority
+// ones.
+type AdmissionPolicy struct {
+	// The starting concurrency limit.  Default 20.
+	InitialLimit int
+	// The bounds on the concurrency limit.  Defaults 1 and 1000.
+	MinLimit int
+	MaxLimit int
+	// The latency above which the limit is reduced.  Default is twice the
+	// lowest latency seen in the current and previous Window.
+	TargetLatency time.Duration
+	// The factor the limit is multiplied by when requests are too slow.  Default 0.9.
+	Backoff float64
+	// The period over which the lowest latency is tracked, and the limit is reduced at most once.  Default 1 second.
+	Window time.Duration
+	// The fraction of the limit available to each priority.  Priorities
+	// missing from the map get their default: high 1, normal 0.9, low 0.5.
+	Shares map[Priority]float64
+}
+
+var defaultShares = map[Priority]float64{
+	PriorityHigh:   1,
+	PriorityNormal: 0.9,
+	PriorityLow:    0.5,
+}
+
+// admission is the state of admission control for a KVStore
+type admission struct {
+	policy AdmissionPolicy
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+
+	// the lowest latencies in the current and previous windows, and whether the limit has been reduced in this one
+	windowStart time.Time
+	windowMin   time.Duration
+	prevMin     time.Duration
+	decreased   bool
+}
+
+func newAdmission(policy AdmissionPolicy) *admission {
+
+	if policy.InitialLimit == 0 {
+		policy.InitialLimit = 20
+	}
+	if policy.MinLimit == 0 {
+		policy.MinLimit = 1
+	}
+	if policy.MaxLimit == 0 {
+		policy.MaxLimit = 1000
+	}
+	if policy.Backoff == 0 {
+		policy.Backoff = 0.9
+	}
+	if policy.Window == 0 {
+		policy.Window = time.Second
+	}
+	if policy.Shares == nil {
+		policy.Shares = defaultShares
+	}
+
+	return &admission{
+		policy:      policy,
+		limit:       float64(policy.InitialLimit),
+		windowStart: timeNow(),
+	}
+}
+
+// admit reserves a slot for a request of priority p
+func (a *admission) admit(p Priority) error {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	share, ok := a.policy.Shares[p]
+	if !ok {
+		share, ok = defaultShares[p]
+	}
+	if !ok {
+		share = 1
+	}
+
+	if float64(a.inflight) >= a.limit*share {
+		return ErrOverloaded
+	}
+
+	a.inflight++
+	return nil
+}
+
+// done releases the slot for a request that took latency.  If measured is
+// true, the latency is used to adjust the limit.
+func (a *admission) done(latency time.Duration, measured bool) {
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inflight--
+
+	if now := timeNow(); now.Sub(a.windowStart) >= a.policy.Window {
+		a.windowStart = now
+		a.prevMin = a.windowMin
+		a.windowMin = 0
+		a.decreased = false
+	}
+
+	if !measured {
+		return
+	}
+
+	if a.windowMin == 0 || latency < a.windowMin {
+		a.windowMin = latency
+	}
+
+	target := a.policy.TargetLatency
+	if target == 0 {
+		baseline := a.windowMin
+		if a.prevMin != 0 && a.prevMin < baseline {
+			baseline = a.prevMin
+		}
+		target = 2 * baseline
+	}
+
+	if latency <= target {
+		// additive increase: about one more per limit's worth of requests
+		a.limit += 1 / a.limit
+	} else if !a.decreased {
+		// the requests in flight now were all admitted under the old limit, so only back off once per window
+		a.limit *= a.policy.Backoff
+		a.decreased = true
+	}
+
+	if min := float64(a.policy.MinLimit); a.limit < min {
+		a.limit = min
+	}
+	if max := float64(a.policy.MaxLimit); a.limit > max {
+		a.limit = max
+	}
+}
+
+// SetAdmission enables admission control with the given policy.  A nil policy disables it.
+func (kv *KVStore) SetAdmission(policy *AdmissionPolicy) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if policy == nil {
+		kv.admission = nil
+		return
+	}
+
+	kv.admission = newAdmission(*policy)
+}
+
+// admit applies admission control to a request of priority p.  If the
+// request is admitted, release must be called when it finishes, with measured
+// true if it did real work and its latency should adjust the limit.
+func (kv *KVStore) admit(p Priority) (release func(measured bool), err error) {
+
+	kv.mu.Lock()
+	a := kv.admission
+	kv.mu.Unlock()
+
+	if a == nil {
+		return func(bool) {}, nil
+	}
+
+	if err := a.admit(p); err != nil {
+		return nil, err
+	}
+
+	start := timeNow()
+	return func(measured bool) { a.done(timeNow().Sub(start), measured) }, nil
+}
+
+// getPriority and writePriority are the priorities of requests made directly on a KVStore
+const (
+	getPriority   = PriorityNormal
+	writePriority = PriorityLow
+)
+
+// WithPriority returns a Storage which sends requests to the store with priority p
+func (kv *KVStore) WithPriority(p Priority) Storage {
+	return &prioritized{kv: kv, p: p}
+}
+
+type prioritized struct {
+	kv *KVStore
+	p  Priority
+}
+
+func (s *prioritized) Get(key string) ([]byte, bool, error) {
+	return s.kv.getWithPriority(key, s.p)
+}
+
+func (s *prioritized) Set(key string, val []byte) error {
+	return s.kv.setWithPriority(key, val, s.p)
+}
+
+func (s *prioritized) Delete(key string) (bool, error) {
+	return s.kv.deleteWithPriority(key, s.p)
+}
+
+func (s *prioritized) ResetConnection(key string) error {
+	return s.kv.ResetConnection(key)
+}
@@ -0,0 +1,177 @@
+package shardedkv
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	ch "github.com/dgryski/go-shardedkv/choosers/chash"
+	st "github.com/dgryski/go-shardedkv/storage/memory"
+)
+
+func TestAdmission(t *testing.T) {
+
+	kv := New(ch.New(), []Shard{{Name: "shard1", Backend: st.New()}})
+	kv.SetAdmission(&AdmissionPolicy{InitialLimit: 10, MaxLimit: 10})
+
+	a := kv.admission
+
+	// fill up to the low priority share of the limit
+	for i := 0; i < 5; i++ {
+		if err := a.admit(PriorityLow); err != nil {
+			t.Fatalf("low priority request %d rejected: %v", i, err)
+		}
+	}
+
+	if _, _, err := kv.WithPriority(PriorityLow).Get("foo"); err != ErrOverloaded {
+		t.Errorf("low priority request over its share: got %v, want ErrOverloaded", err)
+	}
+
+	// writes default to low priority, so are shed before reads
+	if err := kv.Set("foo", []byte("bar")); err != ErrOverloaded {
+		t.Errorf("default priority write over the low share: got %v, want ErrOverloaded", err)
+	}
+
+	if err := kv.WithPriority(PriorityNormal).Set("foo", []byte("bar")); err != nil {
+		t.Errorf("normal priority request rejected: %v", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		if err := a.admit(PriorityNormal); err != nil {
+			t.Fatalf("normal priority request %d rejected: %v", i, err)
+		}
+	}
+
+	if _, _, err := kv.Get("foo"); err != ErrOverloaded {
+		t.Errorf("normal priority request over its share: got %v, want ErrOverloaded", err)
+	}
+
+	if !errors.Is(ErrOverloaded, ErrRejected) || IsRetriable(ErrOverloaded) {
+		t.Errorf("ErrOverloaded isn't a non-retriable ErrRejected")
+	}
+
+	if val, ok, err := kv.WithPriority(PriorityHigh).Get("foo"); err != nil || !ok || string(val) != "bar" {
+		t.Errorf("high priority Get()=(%q,%v,%v), want (bar,true,nil)", val, ok, err)
+	}
+
+	kv.SetAdmission(nil)
+	for i := 0; i < 20; i++ {
+		if _, _, err := kv.WithPriority(PriorityLow).Get("foo"); err != nil {
+			t.Fatalf("request with admission control disabled failed: %v", err)
+		}
+	}
+}
+
+// mockClock sets timeNow to a clock which only moves when advanced, and returns the function to advance it
+func mockClock(t *testing.T) func(d time.Duration) {
+	now := time.Unix(0, 0)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAdmissionLimit(t *testing.T) {
+
+	advance := mockClock(t)
+
+	a := newAdmission(AdmissionPolicy{InitialLimit: 10, MinLimit: 2, MaxLimit: 20, TargetLatency: 10 * time.Millisecond})
+
+	// fast requests raise the limit
+	for i := 0; i < 100; i++ {
+		a.admit(PriorityHigh)
+		a.done(time.Millisecond, true)
+	}
+
+	if a.limit <= 10 || a.limit > 20 {
+		t.Errorf("limit after fast requests = %v, want (10,20]", a.limit)
+	}
+
+	// many slow requests in one window only lower it once
+	limit := a.limit
+	for i := 0; i < 10; i++ {
+		a.admit(PriorityHigh)
+		a.done(50*time.Millisecond, true)
+	}
+
+	if a.limit != limit*0.9 {
+		t.Errorf("limit after slow requests in one window = %v, want %v", a.limit, limit*0.9)
+	}
+
+	// but keep lowering it window after window
+	for i := 0; i < 100; i++ {
+		advance(time.Second)
+		a.admit(PriorityHigh)
+		a.done(50*time.Millisecond, true)
+	}
+
+	if a.limit != 2 {
+		t.Errorf("limit after slow requests = %v, want 2", a.limit)
+	}
+
+	if a.inflight != 0 {
+		t.Errorf("inflight=%d, want 0", a.inflight)
+	}
+
+	// requests which aren't measured don't change it
+	for i := 0; i < 100; i++ {
+		advance(time.Second)
+		a.admit(PriorityHigh)
+		a.done(time.Hour, false)
+	}
+
+	if a.limit != 2 {
+		t.Errorf("limit after unmeasured requests = %v, want 2", a.limit)
+	}
+}
+
+func TestAdmissionBaseline(t *testing.T) {
+
+	advance := mockClock(t)
+
+	// without a target, requests much slower than the fastest lower the limit
+	a := newAdmission(AdmissionPolicy{})
+	a.admit(PriorityHigh)
+	a.done(time.Millisecond, true)
+	limit := a.limit
+
+	a.admit(PriorityHigh)
+	a.done(10*time.Millisecond, true)
+	if a.limit >= limit {
+		t.Errorf("limit after slow request = %v, want < %v", a.limit, limit)
+	}
+
+	// a single very fast request only sets the baseline for a couple of windows
+	a = newAdmission(AdmissionPolicy{})
+	a.admit(PriorityHigh)
+	a.done(2*time.Microsecond, true)
+
+	for i := 0; i < 200; i++ {
+		advance(50 * time.Millisecond)
+		a.admit(PriorityHigh)
+		a.done(500*time.Microsecond, true)
+	}
+
+	if a.limit < 20 {
+		t.Errorf("limit after steady requests following one fast one = %v, want at least the initial 20", a.limit)
+	}
+}
+
+func TestAdmissionShares(t *testing.T) {
+
+	// priorities missing from Shares keep their default share
+	a := newAdmission(AdmissionPolicy{InitialLimit: 10, MaxLimit: 10, Shares: map[Priority]float64{PriorityLow: 0.3}})
+
+	for i := 0; i < 9; i++ {
+		if err := a.admit(PriorityNormal); err != nil {
+			t.Fatalf("normal priority request %d rejected: %v", i, err)
+		}
+	}
+
+	if err := a.admit(PriorityNormal); err != ErrOverloaded {
+		t.Errorf("normal priority request over its default share: got %v, want ErrOverloaded", err)
+	}
+
+	if err := a.admit(PriorityHigh); err != nil {
+		t.Errorf("high priority request rejected: %v", err)
+	}
+}
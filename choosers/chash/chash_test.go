@@ -5,3 +5,4 @@ import (
 )
 
 var _ shardedkv.Chooser = &CHash{}
+var _ shardedkv.ReplicaChooser = &CHash{}
@@ -56,3 +56,4 @@ func TestCarbonCRelayCompat(t *testing.T) {
 }
 
 var _ shardedkv.Chooser = &Jump{}
+var _ shardedkv.ReplicaChooser = &Jump{}
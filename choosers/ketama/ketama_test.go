@@ -5,3 +5,4 @@ import (
 )
 
 var _ shardedkv.Chooser = &Ketama{}
+var _ shardedkv.ReplicaChooser = &Ketama{}
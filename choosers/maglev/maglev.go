@@ -44,4 +44,28 @@ func (m *Maglev) Choose(key string) string {
 	return m.nodes[node]
 }
 
+// ChooseReplicas returns n distinct buckets for key.  Maglev has no natural
+// successor list, so after the first bucket we probe the table with
+// differently-seeded hashes of the key until we've seen n distinct buckets.
+func (m *Maglev) ChooseReplicas(key string, n int) []string {
+
+	// error instead of panic?
+	if n > len(m.nodes) {
+		panic("maglev: too many replicas requested")
+	}
+
+	seen := make(map[int]bool, n)
+	replicas := make([]string, 0, n)
+
+	for seed := uint64(0); len(replicas) < n; seed++ {
+		node := m.t.Lookup(siphash.Hash(seed, 0, []byte(key)))
+		if !seen[node] {
+			seen[node] = true
+			replicas = append(replicas, m.nodes[node])
+		}
+	}
+
+	return replicas
+}
+
 func (m *Maglev) Buckets() []string { return m.nodes }
@@ -3,3 +3,4 @@ package maglev
 import "github.com/dgryski/go-shardedkv"
 
 var _ shardedkv.Chooser = &Maglev{}
+var _ shardedkv.ReplicaChooser = &Maglev{}
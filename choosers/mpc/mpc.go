@@ -2,6 +2,8 @@
 package mpc
 
 import (
+	"strconv"
+
 	"github.com/dgryski/go-mpchash"
 )
 
@@ -26,4 +28,29 @@ func (m *Multi) SetBuckets(buckets []string) error {
 
 func (m *Multi) Choose(key string) string { return m.mpc.Hash(key) }
 
+// ChooseReplicas returns n distinct buckets for key.  After the first bucket,
+// we probe with suffixed copies of the key until we've seen n distinct buckets.
+func (m *Multi) ChooseReplicas(key string, n int) []string {
+
+	// error instead of panic?
+	if n > len(m.s) {
+		panic("mpc: too many replicas requested")
+	}
+
+	seen := make(map[string]bool, n)
+	replicas := make([]string, 0, n)
+
+	k := key
+	for i := 1; len(replicas) < n; i++ {
+		b := m.mpc.Hash(k)
+		if !seen[b] {
+			seen[b] = true
+			replicas = append(replicas, b)
+		}
+		k = key + "\x00" + strconv.Itoa(i)
+	}
+
+	return replicas
+}
+
 func (m *Multi) Buckets() []string { return m.s }
@@ -5,3 +5,4 @@ import (
 )
 
 var _ shardedkv.Chooser = &Multi{}
+var _ shardedkv.ReplicaChooser = &Multi{}
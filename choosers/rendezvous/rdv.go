@@ -9,6 +9,7 @@ import (
 type Rendezvous struct {
 	r     *rendezvous.Rendezvous
 	nodes []string
+	nhash []uint64
 }
 
 func New() *Rendezvous {
@@ -27,6 +28,11 @@ func (r *Rendezvous) SetBuckets(buckets []string) error {
 	r.nodes = append(r.nodes, buckets...)
 	r.r = rendezvous.New(buckets, metrohasher)
 
+	r.nhash = make([]uint64, len(buckets))
+	for i, b := range buckets {
+		r.nhash[i] = metrohasher(b)
+	}
+
 	return nil
 }
 
@@ -35,4 +41,45 @@ func (r *Rendezvous) Choose(k string) string {
 	return node
 }
 
+// ChooseReplicas returns the n buckets with the highest scores for k.  The scoring matches go-rendezvous, so the first replica is the one returned by Choose.
+func (r *Rendezvous) ChooseReplicas(k string, n int) []string {
+
+	// error instead of panic?
+	if n > len(r.nodes) {
+		panic("rendezvous: too many replicas requested")
+	}
+
+	khash := metrohasher(k)
+
+	idx := make([]int, len(r.nodes))
+	scores := make([]uint64, len(r.nodes))
+	for i, nhash := range r.nhash {
+		idx[i] = i
+		scores[i] = xorshiftMult64(khash ^ nhash)
+	}
+
+	// partial selection sort -- n is expected to be small
+	replicas := make([]string, n)
+	for i := 0; i < n; i++ {
+		m := i
+		for j := i + 1; j < len(idx); j++ {
+			if scores[idx[j]] > scores[idx[m]] {
+				m = j
+			}
+		}
+		idx[i], idx[m] = idx[m], idx[i]
+		replicas[i] = r.nodes[idx[i]]
+	}
+
+	return replicas
+}
+
 func (r *Rendezvous) Buckets() []string { return r.nodes }
+
+// 64-bit xorshift multiply rng from http://vigna.di.unimi.it/ftp/papers/xorshift.pdf
+func xorshiftMult64(x uint64) uint64 {
+	x ^= x >> 12 // a
+	x ^= x << 25 // b
+	x ^= x >> 27 // c
+	return x * 2685821657736338717
+}
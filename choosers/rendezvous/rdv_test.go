@@ -1,5 +1,35 @@
 package rendezvous
 
-import "github.com/dgryski/go-shardedkv"
+import (
+	"strconv"
+	"testing"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+func TestChooseReplicas(t *testing.T) {
+
+	var buckets []string
+	for i := 0; i < 10; i++ {
+		buckets = append(buckets, "shard-"+strconv.Itoa(i))
+	}
+
+	r := New()
+	r.SetBuckets(buckets)
+
+	for i := 0; i < 1000; i++ {
+		k := "key" + strconv.Itoa(i)
+		replicas := r.ChooseReplicas(k, 3)
+
+		if replicas[0] != r.Choose(k) {
+			t.Errorf("r.ChooseReplicas(%q)[0]=%q, want %q", k, replicas[0], r.Choose(k))
+		}
+
+		if replicas[0] == replicas[1] || replicas[0] == replicas[2] || replicas[1] == replicas[2] {
+			t.Errorf("r.ChooseReplicas(%q)=%v has duplicates", k, replicas)
+		}
+	}
+}
 
 var _ shardedkv.Chooser = &Rendezvous{}
+var _ shardedkv.ReplicaChooser = &Rendezvous{}
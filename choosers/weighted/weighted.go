@@ -14,6 +14,9 @@ type Weighted struct {
 	lookup func(string) int
 
 	buckets []string
+
+	// the number of weighted buckets given to the underlying chooser
+	nbuckets int
 }
 
 func New(chooser shardedkv.Chooser, lookup func(string) int) *Weighted {
@@ -38,6 +41,7 @@ func (w *Weighted) SetBuckets(buckets []string) error {
 
 	w.chooser.SetBuckets(mbuckets)
 	w.buckets = buckets
+	w.nbuckets = len(mbuckets)
 
 	return nil
 }
@@ -48,6 +52,58 @@ func (w *Weighted) Choose(key string) string {
 	return m[:l]
 }
 
+// SupportsReplicas reports whether the underlying chooser is a shardedkv.ReplicaChooser, so ChooseReplicas can be used
+func (w *Weighted) SupportsReplicas() bool {
+	rc, ok := w.chooser.(shardedkv.ReplicaChooser)
+	if !ok {
+		return false
+	}
+	if p, ok := rc.(interface{ SupportsReplicas() bool }); ok {
+		return p.SupportsReplicas()
+	}
+	return true
+}
+
+// ChooseReplicas returns n distinct buckets for key.  The underlying chooser must be a shardedkv.ReplicaChooser.
+func (w *Weighted) ChooseReplicas(key string, n int) []string {
+
+	rc, ok := w.chooser.(shardedkv.ReplicaChooser)
+	if !ok {
+		panic("weighted: underlying chooser doesn't support replicas")
+	}
+
+	// error instead of panic?
+	if n > len(w.buckets) {
+		panic("weighted: too many replicas requested")
+	}
+
+	// several weighted buckets map to the same real bucket, so keep asking
+	// for more until we have enough distinct ones
+	for m := n; ; m *= 2 {
+		if m > w.nbuckets {
+			m = w.nbuckets
+		}
+
+		seen := make(map[string]bool, n)
+		replicas := make([]string, 0, n)
+		for _, b := range rc.ChooseReplicas(key, m) {
+			b = b[:strings.LastIndex(b, "#")]
+			if !seen[b] {
+				seen[b] = true
+				replicas = append(replicas, b)
+				if len(replicas) == n {
+					return replicas
+				}
+			}
+		}
+
+		if m == w.nbuckets {
+			// only possible if some buckets have zero weight
+			panic("weighted: too many replicas requested")
+		}
+	}
+}
+
 func (w *Weighted) Buckets() []string {
 	return w.buckets
 }
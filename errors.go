@@ -0,0 +1,58 @@
+package shardedkv
+
+import "errors"
+
+// Storage backends classify their errors by wrapping them with one of these,
+// so callers and wrappers can test for them with errors.Is.
+var (
+	// ErrUnavailable means the storage couldn't be reached or isn't currently serving requests.  Retrying may succeed.
+	ErrUnavailable = errors.New("shardedkv: storage unavailable")
+	// ErrTimeout means the storage didn't respond in time.  Retrying may succeed.
+	ErrTimeout = errors.New("shardedkv: storage timeout")
+	// ErrNotFound means an operation required a key that doesn't exist.
+	// Get and Delete report missing keys with a false bool instead, so
+	// ErrNotFound is never a storage failure.
+	ErrNotFound = errors.New("shardedkv: key not found")
+	// ErrConflict means the write conflicted with the current value of the key
+	ErrConflict = errors.New("shardedkv: conflict")
+	// ErrTooLarge means the key or value was too large for the storage
+	ErrTooLarge = errors.New("shardedkv: too large")
+	// ErrInvalid means the storage rejected the request itself as invalid,
+	// such as a malformed key or a request it isn't authorized to make.  It
+	// isn't a storage failure, and retrying won't help.
+	ErrInvalid = errors.New("shardedkv: invalid request")
+	// ErrRejected means the request was shed by rate limiting or admission
+	// control, either locally or by a server in front of the storage, without
+	// reaching the storage.  It isn't a storage failure, and retrying straight
+	// away won't help.
+	ErrRejected = errors.New("shardedkv: request rejected")
+)
+
+// Error is an error from a storage backend, classified by Kind
+type Error struct {
+	// Kind is one of the sentinel errors, such as ErrUnavailable
+	Kind error
+	// Err is the underlying error from the backend
+	Err error
+}
+
+// NewError returns err classified as kind, or nil if err is nil
+func NewError(kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the error's Kind, so errors.Is(err, ErrUnavailable) works
+func (e *Error) Is(target error) bool { return target == e.Kind }
+
+// IsRetriable reports whether err is classified as ErrUnavailable or ErrTimeout
+func IsRetriable(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
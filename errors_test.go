@@ -0,0 +1,55 @@
+package shardedkv
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+
+	if err := NewError(ErrTimeout, nil); err != nil {
+		t.Errorf("NewError(ErrTimeout, nil)=%v, want nil", err)
+	}
+
+	base := errors.New("read tcp: i/o timeout")
+	err := fmt.Errorf("get foo: %w", NewError(ErrTimeout, base))
+
+	if !errors.Is(err, ErrTimeout) || !errors.Is(err, base) {
+		t.Errorf("wrapped error doesn't match its kind and cause: %v", err)
+	}
+
+	if errors.Is(err, ErrUnavailable) {
+		t.Errorf("timeout error matches ErrUnavailable")
+	}
+
+	if !IsRetriable(err) || IsRetriable(NewError(ErrConflict, base)) || IsRetriable(base) {
+		t.Errorf("IsRetriable misclassified errors")
+	}
+
+	if IsRetriable(NewError(ErrRejected, base)) {
+		t.Errorf("IsRetriable(ErrRejected)=true")
+	}
+
+	if err.Error() != "get foo: read tcp: i/o timeout" {
+		t.Errorf("err.Error()=%q", err.Error())
+	}
+}
+
+func TestQuorumError(t *testing.T) {
+
+	tooLarge := &QuorumError{Needed: 2, Errors: []error{NewError(ErrTooLarge, errors.New("big")), NewError(ErrTooLarge, errors.New("big"))}}
+	if !errors.Is(tooLarge, ErrTooLarge) || IsRetriable(tooLarge) {
+		t.Errorf("quorum of ErrTooLarge errors misclassified")
+	}
+
+	invalid := &QuorumError{Needed: 2, Errors: []error{NewError(ErrInvalid, errors.New("bad key")), NewError(ErrInvalid, errors.New("bad key"))}}
+	if !errors.Is(invalid, ErrInvalid) || errors.Is(invalid, ErrUnavailable) || IsRetriable(invalid) {
+		t.Errorf("quorum of ErrInvalid errors misclassified")
+	}
+
+	unknown := &QuorumError{Needed: 2, Errors: []error{errors.New("down"), NewError(ErrConflict, errors.New("conflict"))}}
+	if !errors.Is(unknown, ErrUnavailable) || !errors.Is(unknown, ErrConflict) || errors.Is(unknown, ErrTimeout) {
+		t.Errorf("quorum of unclassified and conflict errors misclassified")
+	}
+}
@@ -0,0 +1,352 @@
+package shardedkv
+
+import "sync"
+
+// FailoverPolicy configures a KVStore to send requests for keys whose shard
+// is failing to a fallback shard.
+//
+// The fallback shard is the second replica from the continuum if it is a
+// ReplicaChooser, and otherwise the shard chosen by a chooser from NewChooser
+// over all the buckets except the failed one.
+//
+// Writes sent to a fallback shard are remembered, and reads of those keys are
+// served from the fallback until the key has been handed back to the primary
+// shard.  This happens the next time the key is read once the primary has
+// recovered, or for all keys at once by calling HandBack.
+//
+// These hints are only kept in memory, and there is no limit on how many
+// there are.  They're lost if the process restarts before the keys have been
+// handed back, after which the primary shard serves the stale values it held
+// before it failed.
+//
+// Fail-over isn't used during a migration, or by a replicated KVStore, which
+// already tolerates failed shards.
+type FailoverPolicy struct {
+	// Reads, if true, sends reads to the fallback shard when the primary fails
+	Reads bool
+	// Writes, if true, sends writes to the fallback shard when the primary fails
+	Writes bool
+	// ShouldFailover reports whether an error means the primary is failing.
+	// The default fails over on any error.  With backoff storages, use
+	// something like func(err error) bool { return err == backoff.ErrBackingOff }
+	ShouldFailover func(err error) bool
+	// NewChooser returns an empty chooser of the same kind as the continuum,
+	// for choosing fallback shards when it isn't a ReplicaChooser.
+	NewChooser func() Chooser
+}
+
+// hint records that the latest write for a key went to a fallback shard
+type hint struct {
+	shard   string
+	deleted bool
+	seq     uint64
+}
+
+// SetFailover sets the fail-over policy.  A nil policy disables fail-over.
+// Keys which haven't been handed back yet are kept, and are still read from
+// their fallback shard until they're handed back.
+func (kv *KVStore) SetFailover(policy *FailoverPolicy) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.failover = policy
+	kv.fallbacks = nil
+}
+
+func (p *FailoverPolicy) shouldFailover(err error) bool {
+	if p == nil || err == nil {
+		return false
+	}
+	if p.ShouldFailover == nil {
+		return true
+	}
+	return p.ShouldFailover(err)
+}
+
+// fallback returns the fallback shard and storage for a key whose primary shard is failing
+func (kv *KVStore) fallback(key, primary string) (string, Storage, bool) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	buckets := kv.continuum.Buckets()
+	if len(buckets) < 2 {
+		return "", nil, false
+	}
+
+	var shard string
+
+	if rc, ok := kv.continuum.(ReplicaChooser); ok {
+		shard = rc.ChooseReplicas(key, 2)[1]
+	} else {
+		if kv.failover == nil || kv.failover.NewChooser == nil {
+			return "", nil, false
+		}
+
+		chooser, ok := kv.fallbacks[primary]
+		if !ok {
+			var remaining []string
+			for _, b := range buckets {
+				if b != primary {
+					remaining = append(remaining, b)
+				}
+			}
+
+			chooser = kv.failover.NewChooser()
+			chooser.SetBuckets(remaining)
+
+			if kv.fallbacks == nil {
+				kv.fallbacks = make(map[string]Chooser)
+			}
+			kv.fallbacks[primary] = chooser
+		}
+
+		shard = chooser.Choose(key)
+	}
+
+	storage, ok := kv.storages[shard]
+	return shard, storage, ok
+}
+
+// addHint records that the latest write for key went to shard
+func (kv *KVStore) addHint(key, shard string, deleted bool) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.hints == nil {
+		kv.hints = make(map[string]hint)
+	}
+
+	kv.hintSeq++
+	kv.hints[key] = hint{shard: shard, deleted: deleted, seq: kv.hintSeq}
+}
+
+// findHint returns the hint for key, if any
+func (kv *KVStore) findHint(key string) (hint, Storage, bool) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	h, ok := kv.hints[key]
+	if !ok {
+		return hint{}, nil, false
+	}
+
+	return h, kv.storages[h.shard], true
+}
+
+// clearHint removes the hint for key, if it hasn't been replaced by a later one
+func (kv *KVStore) clearHint(key string, h hint) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.hints[key] == h {
+		delete(kv.hints, key)
+	}
+}
+
+// hasHints reports whether any keys are waiting to be handed back.  The caller must hold kv.mu.
+func (kv *KVStore) hasHints() bool {
+	return len(kv.hints) > 0
+}
+
+// keyLock is a lock for a single key, along with the number of requests holding or waiting for it
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey serializes hand-backs and writes to the primary for key, so a
+// hand-back can't overwrite a newer write.  Each key has its own lock, so a
+// write waiting on a failing shard doesn't hold up writes to other keys.
+func (kv *KVStore) lockKey(key string) func() {
+
+	kv.mu.Lock()
+	l, ok := kv.keyLocks[key]
+	if !ok {
+		if kv.keyLocks == nil {
+			kv.keyLocks = make(map[string]*keyLock)
+		}
+		l = &keyLock{}
+		kv.keyLocks[key] = l
+	}
+	l.refs++
+	kv.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		kv.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(kv.keyLocks, key)
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// currentHint reports whether h is still the latest hint for key
+func (kv *KVStore) currentHint(key string, h hint) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return kv.hints[key] == h
+}
+
+// handBack copies the latest write for key from its fallback shard to the primary
+func (kv *KVStore) handBack(key string, h hint, primary, fallback Storage) error {
+
+	defer kv.lockKey(key)()
+
+	if !kv.currentHint(key, h) {
+		// a later write has already dealt with it
+		return nil
+	}
+
+	if h.deleted {
+		if _, err := primary.Delete(key); err != nil {
+			return err
+		}
+	} else {
+		val, ok, err := fallback.Get(key)
+		if err != nil {
+			return err
+		}
+
+		if ok {
+			err = primary.Set(key, val)
+		} else {
+			_, err = primary.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+
+		// the fallback doesn't own this key, so don't leave a stale copy behind
+		fallback.Delete(key)
+	}
+
+	kv.clearHint(key, h)
+	return nil
+}
+
+// HandBack copies all keys written to fallback shards back to their primary
+// shards.  Keys whose primary is still failing are left on the fallback, and
+// the last error is returned.
+func (kv *KVStore) HandBack() error {
+
+	kv.mu.Lock()
+	hints := make(map[string]hint, len(kv.hints))
+	for k, h := range kv.hints {
+		hints[k] = h
+	}
+	kv.mu.Unlock()
+
+	var lastErr error
+	for key, h := range hints {
+
+		kv.mu.Lock()
+		primary := kv.storages[kv.continuum.Choose(key)]
+		fallback := kv.storages[h.shard]
+		kv.mu.Unlock()
+
+		if err := kv.handBack(key, h, primary, fallback); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func (kv *KVStore) getFailover(key, shard string, storage Storage, policy *FailoverPolicy) ([]byte, bool, error) {
+
+	if h, fallback, ok := kv.findHint(key); ok {
+		if err := kv.handBack(key, h, storage, fallback); err != nil {
+			// the primary is still failing, so the fallback has the latest value
+			if h.deleted {
+				return nil, false, nil
+			}
+			return fallback.Get(key)
+		}
+	}
+
+	val, ok, err := storage.Get(key)
+	if policy == nil || !policy.Reads || !policy.shouldFailover(err) {
+		return val, ok, err
+	}
+
+	_, fallback, fok := kv.fallback(key, shard)
+	if !fok {
+		return val, ok, err
+	}
+
+	return fallback.Get(key)
+}
+
+func (kv *KVStore) setFailover(key string, val []byte, shard string, storage Storage, policy *FailoverPolicy) error {
+
+	defer kv.lockKey(key)()
+
+	err := storage.Set(key, val)
+	if err == nil {
+		// any copy on a fallback shard is now out of date
+		if h, fallback, ok := kv.findHint(key); ok {
+			fallback.Delete(key)
+			kv.clearHint(key, h)
+		}
+		return nil
+	}
+
+	if policy == nil || !policy.Writes || !policy.shouldFailover(err) {
+		return err
+	}
+
+	fshard, fallback, ok := kv.fallback(key, shard)
+	if !ok {
+		return err
+	}
+
+	if err := fallback.Set(key, val); err != nil {
+		return err
+	}
+
+	kv.addHint(key, fshard, false)
+	return nil
+}
+
+func (kv *KVStore) deleteFailover(key, shard string, storage Storage, policy *FailoverPolicy) (bool, error) {
+
+	defer kv.lockKey(key)()
+
+	ok, err := storage.Delete(key)
+	if err == nil {
+		if h, fallback, hok := kv.findHint(key); hok {
+			fok, _ := fallback.Delete(key)
+			ok = ok || (fok && !h.deleted)
+			kv.clearHint(key, h)
+		}
+		return ok, nil
+	}
+
+	if policy == nil || !policy.Writes || !policy.shouldFailover(err) {
+		return ok, err
+	}
+
+	fshard, fallback, fok := kv.fallback(key, shard)
+	if !fok {
+		return ok, err
+	}
+
+	ok, err = fallback.Delete(key)
+	if err != nil {
+		return false, err
+	}
+
+	// remember to delete it from the primary too
+	kv.addHint(key, fshard, true)
+	return ok, nil
+}
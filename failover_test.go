@@ -0,0 +1,331 @@
+package shardedkv
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	ch "github.com/dgryski/go-shardedkv/choosers/chash"
+	st "github.com/dgryski/go-shardedkv/storage/memory"
+)
+
+var errDown = errors.New("shard down")
+
+// a storage which can be marked as down
+type switchable struct {
+	*st.Storage
+	mu   sync.Mutex
+	down bool
+}
+
+func (s *switchable) isDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.down
+}
+
+func (s *switchable) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+func (s *switchable) Get(key string) ([]byte, bool, error) {
+	if s.isDown() {
+		return nil, false, errDown
+	}
+	return s.Storage.Get(key)
+}
+
+func (s *switchable) Set(key string, val []byte) error {
+	if s.isDown() {
+		return errDown
+	}
+	return s.Storage.Set(key, val)
+}
+
+func (s *switchable) Delete(key string) (bool, error) {
+	if s.isDown() {
+		return false, errDown
+	}
+	return s.Storage.Delete(key)
+}
+
+func TestFailover(t *testing.T) {
+	var shards []Shard
+	nElements := 1000
+	nShards := 5
+
+	backends := make(map[string]*switchable)
+	for i := 0; i < nShards; i++ {
+		label := "test_shard" + strconv.Itoa(i)
+		b := &switchable{Storage: st.New()}
+		backends[label] = b
+		shards = append(shards, Shard{Name: label, Backend: b})
+	}
+
+	kv := New(ch.New(), shards)
+	kv.SetFailover(&FailoverPolicy{
+		Reads:          true,
+		Writes:         true,
+		ShouldFailover: func(err error) bool { return err == errDown },
+	})
+
+	for i := 0; i < nElements; i++ {
+		kv.Set("test"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i)))
+	}
+
+	down := backends["test_shard0"]
+	down.setDown(true)
+
+	// writes to the failed shard should go to a fallback
+	for i := 0; i < nElements; i++ {
+		if err := kv.Set("test"+strconv.Itoa(i), []byte("new"+strconv.Itoa(i))); err != nil {
+			t.Fatalf("error setting key with a failed shard: %v", err)
+		}
+	}
+
+	for i := 0; i < nElements; i++ {
+		k := "test" + strconv.Itoa(i)
+		v, ok, err := kv.Get(k)
+		if !ok || err != nil || string(v) != "new"+strconv.Itoa(i) {
+			t.Errorf("failed getting %q with a failed shard: v=%q ok=%v err=%v", k, v, ok, err)
+		}
+	}
+
+	// once the shard is back, reads must not see the stale values it holds
+	down.setDown(false)
+
+	for i := 0; i < nElements/2; i++ {
+		k := "test" + strconv.Itoa(i)
+		v, ok, err := kv.Get(k)
+		if !ok || err != nil || string(v) != "new"+strconv.Itoa(i) {
+			t.Errorf("failed getting %q after recovery: v=%q ok=%v err=%v", k, v, ok, err)
+		}
+	}
+
+	if err := kv.HandBack(); err != nil {
+		t.Errorf("error handing back keys: %v", err)
+	}
+
+	if len(kv.hints) != 0 {
+		t.Errorf("%d keys not handed back", len(kv.hints))
+	}
+
+	// every key should now be on its primary shard, and nowhere else
+	for i := 0; i < nElements; i++ {
+		k := "test" + strconv.Itoa(i)
+
+		var copies int
+		for _, b := range backends {
+			if v, ok, _ := b.Storage.Get(k); ok {
+				copies++
+				if string(v) != "new"+strconv.Itoa(i) {
+					t.Errorf("stale value for %q after hand back: %q", k, v)
+				}
+			}
+		}
+
+		if copies != 1 {
+			t.Errorf("key %q on %d shards after hand back, want 1", k, copies)
+		}
+	}
+}
+
+func TestFailoverDelete(t *testing.T) {
+
+	a := &switchable{Storage: st.New()}
+	b := &switchable{Storage: st.New()}
+
+	kv := New(ch.New(), []Shard{{Name: "a", Backend: a}, {Name: "b", Backend: b}})
+	kv.SetFailover(&FailoverPolicy{Writes: true, NewChooser: func() Chooser { return ch.New() }})
+
+	// find a key that lives on a
+	var key string
+	for i := 0; ; i++ {
+		key = "test" + strconv.Itoa(i)
+		if kv.continuum.Choose(key) == "a" {
+			break
+		}
+	}
+
+	kv.Set(key, []byte("value"))
+	a.setDown(true)
+
+	if _, err := kv.Delete(key); err != nil {
+		t.Fatalf("error deleting with a failed shard: %v", err)
+	}
+
+	a.setDown(false)
+
+	if _, ok, _ := kv.Get(key); ok {
+		t.Errorf("deleted key came back after recovery")
+	}
+
+	if _, ok, _ := a.Get(key); ok {
+		t.Errorf("delete not handed back to the primary")
+	}
+}
+
+func TestFailoverDisabledWithHints(t *testing.T) {
+
+	a := &switchable{Storage: st.New()}
+	b := &switchable{Storage: st.New()}
+
+	kv := New(ch.New(), []Shard{{Name: "a", Backend: a}, {Name: "b", Backend: b}})
+	kv.SetFailover(&FailoverPolicy{Writes: true, NewChooser: func() Chooser { return ch.New() }})
+
+	key := keyOn(kv, "a")
+
+	kv.Set(key, []byte("old"))
+	a.setDown(true)
+	kv.Set(key, []byte("new"))
+	a.setDown(false)
+
+	// the key hasn't been handed back, so it must still be read from the fallback
+	kv.SetFailover(nil)
+
+	if v, ok, err := kv.Get(key); !ok || err != nil || string(v) != "new" {
+		t.Errorf("Get after disabling fail-over=(%q,%v,%v), want new", v, ok, err)
+	}
+
+	if len(kv.hints) != 0 {
+		t.Errorf("%d keys not handed back after a read", len(kv.hints))
+	}
+}
+
+// a storage whose Get can be made to wait until released
+type gatedGet struct {
+	*switchable
+	mu      sync.Mutex
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedGet) arm() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.entered = make(chan struct{})
+	g.release = make(chan struct{})
+}
+
+func (g *gatedGet) Get(key string) ([]byte, bool, error) {
+
+	g.mu.Lock()
+	entered, release := g.entered, g.release
+	g.entered, g.release = nil, nil
+	g.mu.Unlock()
+
+	if entered != nil {
+		close(entered)
+		<-release
+	}
+
+	return g.switchable.Get(key)
+}
+
+func TestFailoverHandBackRace(t *testing.T) {
+
+	a := &switchable{Storage: st.New()}
+	b := &gatedGet{switchable: &switchable{Storage: st.New()}}
+
+	kv := New(ch.New(), []Shard{{Name: "a", Backend: a}, {Name: "b", Backend: b}})
+	kv.SetFailover(&FailoverPolicy{Writes: true, NewChooser: func() Chooser { return ch.New() }})
+
+	key := keyOn(kv, "a")
+
+	a.setDown(true)
+	kv.Set(key, []byte("old"))
+	a.setDown(false)
+
+	// the hand-back reads the old value from the fallback, and a new write arrives before it copies it
+	b.arm()
+	entered, release := b.entered, b.release
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		kv.HandBack()
+	}()
+
+	<-entered
+	go func() {
+		defer wg.Done()
+		kv.Set(key, []byte("new"))
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if v, ok, _ := a.Get(key); !ok || string(v) != "new" {
+		t.Errorf("primary has %q after a hand-back raced a write, want new", v)
+	}
+}
+
+// keyOn returns a key whose primary shard is shard
+func keyOn(kv *KVStore, shard string) string {
+	for i := 0; ; i++ {
+		key := "test" + strconv.Itoa(i)
+		if kv.continuum.Choose(key) == shard {
+			return key
+		}
+	}
+}
+
+// a storage whose writes wait until released
+type blockingSet struct {
+	*switchable
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingSet) Set(key string, val []byte) error {
+	close(b.entered)
+	<-b.release
+	return b.switchable.Set(key, val)
+}
+
+func TestFailoverSlowShard(t *testing.T) {
+
+	slow := &blockingSet{switchable: &switchable{Storage: st.New()}, entered: make(chan struct{}), release: make(chan struct{})}
+	fast := &switchable{Storage: st.New()}
+
+	kv := New(ch.New(), []Shard{{Name: "slow", Backend: slow}, {Name: "fast", Backend: fast}})
+	kv.SetFailover(&FailoverPolicy{Writes: true, NewChooser: func() Chooser { return ch.New() }})
+
+	go kv.Set(keyOn(kv, "slow"), []byte("x"))
+	defer close(slow.release)
+	<-slow.entered
+
+	// a write stuck on one shard doesn't hold up writes to keys on other shards
+	for i := 0; i < 100; i++ {
+		wrote := make(chan error)
+		key := "fast" + strconv.Itoa(i)
+		if kv.continuum.Choose(key) != "fast" {
+			continue
+		}
+
+		go func() { wrote <- kv.Set(key, []byte("y")) }()
+
+		select {
+		case err := <-wrote:
+			if err != nil {
+				t.Fatalf("Set(%q): %v", key, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Set(%q) on a healthy shard blocked behind a slow one", key)
+		}
+	}
+
+	kv.mu.Lock()
+	locks := len(kv.keyLocks)
+	kv.mu.Unlock()
+
+	if locks != 1 {
+		t.Errorf("%d key locks held, want 1 for the stuck write", locks)
+	}
+}
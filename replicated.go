@@ -0,0 +1,415 @@
+package shardedkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplicaChooser is a Chooser which can also map a key to several distinct shards
+type ReplicaChooser interface {
+	Chooser
+	// ChooseReplicas returns n distinct buckets for a given key.  The first bucket is the one returned by Choose.
+	ChooseReplicas(key string, n int) []string
+}
+
+// supportsReplicas reports whether c can choose replicas.  A chooser which
+// wraps another, and so is only a ReplicaChooser if the one it wraps is, can
+// say so with a SupportsReplicas method.
+func supportsReplicas(c Chooser) bool {
+
+	if _, ok := c.(ReplicaChooser); !ok {
+		return false
+	}
+
+	if p, ok := c.(interface{ SupportsReplicas() bool }); ok {
+		return p.SupportsReplicas()
+	}
+
+	return true
+}
+
+// QuorumError is returned by a replicated KVStore when too few shards succeeded to satisfy the quorum
+type QuorumError struct {
+	Needed int
+	Errors []error
+}
+
+func (q *QuorumError) Error() string {
+
+	var errs []string
+	for _, e := range q.Errors {
+		errs = append(errs, e.Error())
+	}
+
+	return fmt.Sprintf("shardedkv: quorum of %d not reached: %s", q.Needed, strings.Join(errs, ";"))
+}
+
+// Is reports whether any of the errors match target.  Errors which aren't
+// classified with one of the error kinds count as ErrUnavailable.
+func (q *QuorumError) Is(target error) bool {
+	for _, e := range q.Errors {
+		if errors.Is(e, target) || (target == ErrUnavailable && !classified(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap returns the errors from the shards
+func (q *QuorumError) Unwrap() []error { return q.Errors }
+
+// classified reports whether err has one of the error kinds
+func classified(err error) bool {
+	for _, kind := range []error{ErrUnavailable, ErrTimeout, ErrNotFound, ErrConflict, ErrTooLarge, ErrInvalid, ErrRejected} {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrNotReplicaChooser is returned when a replicated KVStore is created with, or asked to migrate to, a chooser which can't choose replicas
+var ErrNotReplicaChooser = errors.New("shardedkv: a replicated KVStore needs a ReplicaChooser")
+
+// NewReplicated returns a KVStore that stores each key on n distinct shards
+// selected by chooser.  Reads succeed once readQuorum shards have responded,
+// and writes once writeQuorum shards have acknowledged them.  A quorum of 0
+// waits for all n shards.  Any chooser passed to BeginMigration must also be
+// a ReplicaChooser.
+//
+// Each value is stored with a version, the time of the write, and a read
+// returns the newest of the copies it sees.  A write to a key isn't sent
+// until every shard has answered the previous write to it through this
+// KVStore, so a slow copy of an older value can't land on top of a newer
+// one, and reads see the latest write when readQuorum + writeQuorum > n.
+// The cost is that writes to a key wait for its slowest shard.  Writes from
+// different KVStores aren't ordered like this: they're resolved by their
+// clocks, and a slow write from one can still overwrite a newer write from
+// another on some shards.  Deletes are stored as small tombstones, so a shard
+// which missed the delete can't bring the key back.
+func NewReplicated(chooser ReplicaChooser, shards []Shard, n, readQuorum, writeQuorum int) (*KVStore, error) {
+
+	if !supportsReplicas(chooser) {
+		return nil, ErrNotReplicaChooser
+	}
+
+	if n < 1 || n > len(shards) {
+		return nil, fmt.Errorf("shardedkv: can't store %d replicas on %d shards", n, len(shards))
+	}
+	if readQuorum < 0 || readQuorum > n || writeQuorum < 0 || writeQuorum > n {
+		return nil, fmt.Errorf("shardedkv: quorums of %d and %d are invalid for %d replicas", readQuorum, writeQuorum, n)
+	}
+
+	kv := New(chooser, shards)
+	kv.replicas = n
+	kv.readQuorum = readQuorum
+	kv.writeQuorum = writeQuorum
+	return kv, nil
+}
+
+// checkMigration returns an error if a replicated KVStore can't migrate to continuum with the given number of buckets
+func (kv *KVStore) checkMigration(continuum Chooser, buckets int) error {
+
+	if kv.replicas == 0 {
+		return nil
+	}
+
+	if !supportsReplicas(continuum) {
+		return ErrNotReplicaChooser
+	}
+
+	if buckets < kv.replicas {
+		return fmt.Errorf("shardedkv: can't store %d replicas on %d shards", kv.replicas, buckets)
+	}
+
+	return nil
+}
+
+// The header of a value in a replicated KVStore: a magic string, flags, and the version
+const (
+	recordMagic   = "\xffR"
+	recordHeader  = len(recordMagic) + 1 + 8
+	flagTombstone = 1
+)
+
+// record is a value stored by a replicated KVStore
+type record struct {
+	version   uint64
+	tombstone bool
+	val       []byte
+}
+
+func (r record) encode() []byte {
+
+	b := make([]byte, recordHeader+len(r.val))
+	copy(b, recordMagic)
+	if r.tombstone {
+		b[len(recordMagic)] = flagTombstone
+	}
+	binary.BigEndian.PutUint64(b[len(recordMagic)+1:], r.version)
+	copy(b[recordHeader:], r.val)
+
+	return b
+}
+
+// decodeRecord decodes a stored value.  Values stored without a header, such as by an unreplicated KVStore, have version 0.
+func decodeRecord(b []byte) record {
+
+	if len(b) < recordHeader || string(b[:len(recordMagic)]) != recordMagic {
+		return record{val: b}
+	}
+
+	return record{
+		version:   binary.BigEndian.Uint64(b[len(recordMagic)+1:]),
+		tombstone: b[len(recordMagic)]&flagTombstone != 0,
+		val:       b[recordHeader:],
+	}
+}
+
+// for mocking during testing
+var timeNow = time.Now
+
+// nextVersion returns the version for a write: the current time in
+// nanoseconds, or one more than the last version if the clock hasn't moved on
+func (kv *KVStore) nextVersion() uint64 {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	v := uint64(timeNow().UnixNano())
+	if v <= kv.lastVersion {
+		v = kv.lastVersion + 1
+	}
+	kv.lastVersion = v
+
+	return v
+}
+
+// replicaStorages returns the storages for key in the primary and, if we're migrating, the migration continuum
+func (kv *KVStore) replicaStorages(key string) (storages, migStorages []Storage) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if kv.migration != nil {
+		for _, shard := range kv.migration.(ReplicaChooser).ChooseReplicas(key, kv.replicas) {
+			migStorages = append(migStorages, kv.mstorages[shard])
+		}
+	}
+
+	for _, shard := range kv.continuum.(ReplicaChooser).ChooseReplicas(key, kv.replicas) {
+		storages = append(storages, kv.storages[shard])
+	}
+
+	return storages, migStorages
+}
+
+type quorumResult struct {
+	replica int
+	val     []byte
+	ok      bool
+	err     error
+}
+
+// quorum calls op on each storage in parallel, and returns once need of them
+// have succeeded.  The remaining calls are left to finish in the background.
+func quorum(storages []Storage, need int, op func(Storage) ([]byte, bool, error)) ([]quorumResult, error) {
+
+	if need <= 0 || need > len(storages) {
+		need = len(storages)
+	}
+
+	// buffered so the stragglers don't block after we've returned
+	ch := make(chan quorumResult, len(storages))
+
+	for i, storage := range storages {
+		go func(i int, storage Storage) {
+			r := quorumResult{replica: i}
+			r.val, r.ok, r.err = op(storage)
+			ch <- r
+		}(i, storage)
+	}
+
+	var results []quorumResult
+	var errs []error
+	for range storages {
+		r := <-ch
+		if r.err != nil {
+			errs = append(errs, r.err)
+			if len(errs) > len(storages)-need {
+				return nil, &QuorumError{Needed: need, Errors: errs}
+			}
+			continue
+		}
+
+		results = append(results, r)
+		if len(results) == need {
+			break
+		}
+	}
+
+	return results, nil
+}
+
+// getQuorum returns the newest record for key from the storages which
+// respond, and a bool indicating if any of them had one.  Ties go to the
+// earliest replica.
+func getQuorum(storages []Storage, need int, key string) (record, bool, error) {
+
+	results, err := quorum(storages, need, func(s Storage) ([]byte, bool, error) { return s.Get(key) })
+	if err != nil {
+		return record{}, false, err
+	}
+
+	var best record
+	var bestReplica int
+	var found bool
+
+	for _, r := range results {
+		if !r.ok {
+			continue
+		}
+
+		rec := decodeRecord(r.val)
+		if !found || rec.version > best.version || (rec.version == best.version && r.replica < bestReplica) {
+			best, bestReplica, found = rec, r.replica, true
+		}
+	}
+
+	return best, found, nil
+}
+
+func (kv *KVStore) getReplicated(key string) ([]byte, bool, error) {
+
+	storages, migStorages := kv.replicaStorages(key)
+
+	var rec record
+	var found bool
+	var err error
+
+	if migStorages != nil {
+		rec, found, err = getQuorum(migStorages, kv.readQuorum, key)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !found {
+		rec, found, err = getQuorum(storages, kv.readQuorum, key)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if !found || rec.tombstone {
+		return nil, false, nil
+	}
+
+	return rec.val, true, nil
+}
+
+// orderWrite waits until every shard has answered the previous write to key,
+// and returns the function to call once they've all answered this one
+func (kv *KVStore) orderWrite(key string) (done func()) {
+
+	ch := make(chan struct{})
+
+	kv.mu.Lock()
+	prev := kv.writing[key]
+	if kv.writing == nil {
+		kv.writing = make(map[string]chan struct{})
+	}
+	kv.writing[key] = ch
+	kv.mu.Unlock()
+
+	if prev != nil {
+		<-prev
+	}
+
+	return func() {
+		kv.mu.Lock()
+		if kv.writing[key] == ch {
+			delete(kv.writing, key)
+		}
+		kv.mu.Unlock()
+		close(ch)
+	}
+}
+
+// writeRecord stores rec on the storages for key, after the previous write to key has finished on every shard
+func (kv *KVStore) writeRecord(storages []Storage, key string, rec record) error {
+
+	done := kv.orderWrite(key)
+
+	// the stragglers still count as part of this write after quorum returns
+	var wg sync.WaitGroup
+	wg.Add(len(storages))
+	go func() {
+		wg.Wait()
+		done()
+	}()
+
+	b := rec.encode()
+	_, err := quorum(storages, kv.writeQuorum, func(s Storage) ([]byte, bool, error) {
+		defer wg.Done()
+		return nil, false, s.Set(key, b)
+	})
+	return err
+}
+
+func (kv *KVStore) setReplicated(key string, val []byte) error {
+
+	storages, migStorages := kv.replicaStorages(key)
+
+	if migStorages != nil {
+		storages = migStorages
+	}
+
+	return kv.writeRecord(storages, key, record{version: kv.nextVersion(), val: val})
+}
+
+// deleteReplicated writes a tombstone for key, and reports whether a quorum read found the key beforehand
+func (kv *KVStore) deleteReplicated(key string) (bool, error) {
+
+	_, ok, err := kv.getReplicated(key)
+	if err != nil {
+		return false, err
+	}
+
+	storages, migStorages := kv.replicaStorages(key)
+	tombstone := record{version: kv.nextVersion(), tombstone: true}
+
+	for _, set := range [][]Storage{migStorages, storages} {
+		if set == nil {
+			continue
+		}
+
+		if err := kv.writeRecord(set, key, tombstone); err != nil {
+			return false, err
+		}
+	}
+
+	return ok, nil
+}
+
+func (kv *KVStore) resetConnectionReplicated(key string) error {
+
+	storages, migStorages := kv.replicaStorages(key)
+
+	for _, set := range [][]Storage{migStorages, storages} {
+		if set == nil {
+			continue
+		}
+
+		_, err := quorum(set, kv.writeQuorum, func(s Storage) ([]byte, bool, error) { return nil, false, s.ResetConnection(key) })
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
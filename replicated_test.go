@@ -0,0 +1,246 @@
+package shardedkv
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ch "github.com/dgryski/go-shardedkv/choosers/chash"
+	st "github.com/dgryski/go-shardedkv/storage/memory"
+)
+
+// a storage that always fails; storagetest.Errstore would be an import cycle
+type errstore struct{}
+
+func (e errstore) Get(key string) ([]byte, bool, error) {
+	return nil, false, errors.New("errstore Get")
+}
+func (e errstore) Set(key string, val []byte) error { return errors.New("errstore Set") }
+func (e errstore) Delete(key string) (bool, error)  { return false, errors.New("errstore Delete") }
+func (e errstore) ResetConnection(key string) error { return errors.New("errstore ResetConnection") }
+
+func TestReplicated(t *testing.T) {
+	var shards []Shard
+	nElements := 1000
+	nShards := 10
+
+	for i := 0; i < nShards; i++ {
+		label := "test_shard" + strconv.Itoa(i)
+		shards = append(shards, Shard{Name: label, Backend: st.New()})
+	}
+
+	chooser := ch.New()
+
+	kv, err := NewReplicated(chooser, shards, 3, 2, 3)
+	if err != nil {
+		t.Fatalf("NewReplicated: %v", err)
+	}
+
+	for i := 0; i < nElements; i++ {
+		kv.Set("test"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i)))
+	}
+
+	// every key should be on exactly 3 shards
+	for i := 0; i < nElements; i++ {
+		k := "test" + strconv.Itoa(i)
+
+		var copies int
+		for _, shard := range shards {
+			if _, ok, _ := shard.Backend.Get(k); ok {
+				copies++
+			}
+		}
+
+		if copies != 3 {
+			t.Errorf("key %q stored on %d shards, want 3", k, copies)
+		}
+	}
+
+	// lose one shard and make sure reads still work
+	kv.AddShard(shards[0].Name, errstore{})
+
+	for i := 0; i < nElements; i++ {
+		k := "test" + strconv.Itoa(i)
+
+		v, ok, err := kv.Get(k)
+		if !ok || err != nil {
+			t.Errorf("failed to get key with one failed shard: ok=%v err=%v", ok, err)
+		}
+
+		if string(v) != "value"+strconv.Itoa(i) {
+			t.Errorf("failed to get a valid value: %s != \"value%d\"\n", v, i)
+		}
+	}
+
+	// but writes need all three
+	var failed int
+	for i := 0; i < nElements; i++ {
+		if err := kv.Set("test"+strconv.Itoa(i), []byte("x")); err != nil {
+			if _, ok := err.(*QuorumError); !ok {
+				t.Errorf("error not a QuorumError: %T", err)
+			}
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		t.Errorf("no writes failed with a failed shard and a write quorum of 3")
+	}
+
+	kv.AddShard(shards[0].Name, shards[0].Backend)
+
+	for i := 0; i < nElements; i++ {
+		k := "test" + strconv.Itoa(i)
+		kv.Delete(k)
+		if _, ok, _ := kv.Get(k); ok {
+			t.Errorf("got a key that shouldn't have been there")
+		}
+	}
+}
+
+// a storage whose writes can be made to fail, and whose first write waits until gate is closed
+type flakyWrites struct {
+	Storage
+	failing int32
+	gate    chan struct{}
+	gated   int32
+}
+
+func (f *flakyWrites) Set(key string, val []byte) error {
+	if f.gate != nil && atomic.CompareAndSwapInt32(&f.gated, 0, 1) {
+		<-f.gate
+	}
+	if atomic.LoadInt32(&f.failing) != 0 {
+		return errors.New("flakyWrites Set")
+	}
+	return f.Storage.Set(key, val)
+}
+
+func TestReplicatedMissedWrite(t *testing.T) {
+
+	var shards []Shard
+	var flaky []*flakyWrites
+	for i := 0; i < 3; i++ {
+		f := &flakyWrites{Storage: st.New()}
+		flaky = append(flaky, f)
+		shards = append(shards, Shard{Name: "test_shard" + strconv.Itoa(i), Backend: f})
+	}
+
+	chooser := ch.New()
+	kv, err := NewReplicated(chooser, shards, 3, 2, 2)
+	if err != nil {
+		t.Fatalf("NewReplicated: %v", err)
+	}
+
+	// the primary replica for the key misses the second write and the delete,
+	// and the first write is slow to reach the last replica
+	replicas := chooser.ChooseReplicas("k", 3)
+	var primary, slow *flakyWrites
+	for i, shard := range shards {
+		switch shard.Name {
+		case replicas[0]:
+			primary = flaky[i]
+		case replicas[2]:
+			slow = flaky[i]
+		}
+	}
+
+	slow.gate = make(chan struct{})
+
+	if err := kv.Set("k", []byte("v1")); err != nil {
+		t.Fatalf("quorum Set with one slow replica: %v", err)
+	}
+
+	atomic.StoreInt32(&primary.failing, 1)
+
+	// the second write mustn't be overwritten by the first one landing late
+	wrote := make(chan error)
+	go func() { wrote <- kv.Set("k", []byte("v2")) }()
+	time.Sleep(20 * time.Millisecond)
+	close(slow.gate)
+
+	if err := <-wrote; err != nil {
+		t.Fatalf("quorum Set with one failed replica: %v", err)
+	}
+
+	for i := 0; i < 200; i++ {
+		if v, ok, err := kv.Get("k"); !ok || err != nil || string(v) != "v2" {
+			t.Fatalf("Get after a write missed a replica=(%q,%v,%v), want v2", v, ok, err)
+		}
+	}
+
+	if ok, err := kv.Delete("k"); !ok || err != nil {
+		t.Fatalf("quorum Delete with one failed replica=(%v,%v)", ok, err)
+	}
+
+	for i := 0; i < 200; i++ {
+		if v, ok, err := kv.Get("k"); ok || err != nil {
+			t.Fatalf("Get after a delete missed a replica=(%q,%v,%v), want a miss", v, ok, err)
+		}
+	}
+
+	// once the replica recovers, the key can be written again
+	atomic.StoreInt32(&primary.failing, 0)
+	kv.Set("k", []byte("v3"))
+	if v, ok, _ := kv.Get("k"); !ok || string(v) != "v3" {
+		t.Errorf("Get after recovery=(%q,%v), want v3", v, ok)
+	}
+}
+
+// a chooser which can't choose replicas
+type plainChooser struct {
+	Chooser
+}
+
+// a chooser which is a ReplicaChooser, but reports that it can't choose replicas, like a wrapper around a plainChooser
+type wrappingChooser struct {
+	ReplicaChooser
+}
+
+func (wrappingChooser) SupportsReplicas() bool { return false }
+
+func TestReplicatedValidation(t *testing.T) {
+
+	var shards []Shard
+	for i := 0; i < 3; i++ {
+		shards = append(shards, Shard{Name: "test_shard" + strconv.Itoa(i), Backend: st.New()})
+	}
+
+	if _, err := NewReplicated(ch.New(), shards, 4, 2, 2); err == nil {
+		t.Errorf("NewReplicated with more replicas than shards succeeded")
+	}
+	if _, err := NewReplicated(ch.New(), shards, 3, 4, 2); err == nil {
+		t.Errorf("NewReplicated with a read quorum larger than the replicas succeeded")
+	}
+
+	if _, err := NewReplicated(wrappingChooser{ch.New()}, shards, 3, 2, 2); err != ErrNotReplicaChooser {
+		t.Errorf("NewReplicated with a chooser which can't choose replicas: got %v, want ErrNotReplicaChooser", err)
+	}
+
+	kv, err := NewReplicated(ch.New(), shards, 3, 2, 2)
+	if err != nil {
+		t.Fatalf("NewReplicated: %v", err)
+	}
+
+	if err := kv.BeginMigrationWithShards(plainChooser{ch.New()}, shards); err != ErrNotReplicaChooser {
+		t.Errorf("migrating to a plain chooser: got %v, want ErrNotReplicaChooser", err)
+	}
+	if err := kv.BeginMigrationWithShards(wrappingChooser{ch.New()}, shards); err != ErrNotReplicaChooser {
+		t.Errorf("migrating to a chooser which can't choose replicas: got %v, want ErrNotReplicaChooser", err)
+	}
+	if err := kv.BeginMigrationWithShards(ch.New(), shards[:2]); err == nil {
+		t.Errorf("migrating to fewer shards than replicas succeeded")
+	}
+
+	// the store still works after the rejected migrations
+	kv.Set("k", []byte("v"))
+	if v, ok, err := kv.Get("k"); !ok || err != nil || string(v) != "v" {
+		t.Errorf("Get after a rejected migration=(%q,%v,%v)", v, ok, err)
+	}
+
+	if err := kv.BeginMigrationWithShards(ch.New(), shards); err != nil {
+		t.Errorf("migrating to a ReplicaChooser: %v", err)
+	}
+}
@@ -24,6 +24,12 @@ type Storage interface {
 	ResetConnection(key string) error
 }
 
+// Pinger is implemented by storage backends which can cheaply check they are reachable
+type Pinger interface {
+	// Ping returns an error if the storage is unavailable
+	Ping() error
+}
+
 // KVStore is a sharded key-value store
 type KVStore struct {
 	continuum Chooser
@@ -32,6 +38,24 @@ type KVStore struct {
 	migration Chooser
 	mstorages map[string]Storage
 
+	// if replicas is non-zero, each key is stored on that many shards; see NewReplicated
+	replicas    int
+	readQuorum  int
+	writeQuorum int
+	lastVersion uint64
+	// for each key with a write in flight, closed once every shard has answered it
+	writing map[string]chan struct{}
+
+	// fail-over state; see SetFailover
+	failover  *FailoverPolicy
+	fallbacks map[string]Chooser
+	hints     map[string]hint
+	hintSeq   uint64
+	keyLocks  map[string]*keyLock
+
+	// admission control state; see SetAdmission
+	admission *admission
+
 	// we avoid holding the lock during a call to a storage engine, which may block
 	mu sync.Mutex
 }
@@ -70,21 +94,49 @@ func New(chooser Chooser, shards []Shard) *KVStore {
 
 // Get implements Storage.Get()
 func (kv *KVStore) Get(key string) ([]byte, bool, error) {
+	return kv.getWithPriority(key, getPriority)
+}
+
+func (kv *KVStore) getWithPriority(key string, p Priority) (val []byte, ok bool, err error) {
+
+	release, err := kv.admit(p)
+	if err != nil {
+		return nil, false, err
+	}
+	defer func() { release(ok && err == nil) }()
+
+	return kv.get(key)
+}
+
+func (kv *KVStore) get(key string) ([]byte, bool, error) {
+
+	if kv.replicas > 0 {
+		return kv.getReplicated(key)
+	}
 
 	var storage Storage
 	var migStorage Storage
+	var failover *FailoverPolicy
+	var hinted bool
 
 	kv.mu.Lock()
 
 	if kv.migration != nil {
 		shard := kv.migration.Choose(key)
 		migStorage = kv.mstorages[shard]
+	} else {
+		failover = kv.failover
+		hinted = kv.hasHints()
 	}
 	shard := kv.continuum.Choose(key)
 	storage = kv.storages[shard]
 
 	kv.mu.Unlock()
 
+	if failover != nil || hinted {
+		return kv.getFailover(key, shard, storage, failover)
+	}
+
 	if migStorage != nil {
 		val, ok, err := migStorage.Get(key)
 		if err != nil {
@@ -101,41 +153,97 @@ func (kv *KVStore) Get(key string) ([]byte, bool, error) {
 
 // Set implements Storage.Set()
 func (kv *KVStore) Set(key string, val []byte) error {
+	return kv.setWithPriority(key, val, writePriority)
+}
+
+func (kv *KVStore) setWithPriority(key string, val []byte, p Priority) (err error) {
+
+	release, err := kv.admit(p)
+	if err != nil {
+		return err
+	}
+	defer func() { release(err == nil) }()
+
+	return kv.set(key, val)
+}
+
+func (kv *KVStore) set(key string, val []byte) error {
+
+	if kv.replicas > 0 {
+		return kv.setReplicated(key, val)
+	}
 
 	var storage Storage
+	var shard string
+	var failover *FailoverPolicy
+	var hinted bool
 
 	kv.mu.Lock()
 
 	if kv.migration != nil {
-		shard := kv.migration.Choose(key)
+		shard = kv.migration.Choose(key)
 		storage = kv.mstorages[shard]
 	} else {
-		shard := kv.continuum.Choose(key)
+		shard = kv.continuum.Choose(key)
 		storage = kv.storages[shard]
+		failover = kv.failover
+		hinted = kv.hasHints()
 	}
 
 	kv.mu.Unlock()
 
+	if failover != nil || hinted {
+		return kv.setFailover(key, val, shard, storage, failover)
+	}
+
 	return storage.Set(key, val)
 }
 
 // Delete implements Storage.Delete()
 func (kv *KVStore) Delete(key string) (bool, error) {
+	return kv.deleteWithPriority(key, writePriority)
+}
+
+func (kv *KVStore) deleteWithPriority(key string, p Priority) (ok bool, err error) {
+
+	release, err := kv.admit(p)
+	if err != nil {
+		return false, err
+	}
+	defer func() { release(ok && err == nil) }()
+
+	return kv.del(key)
+}
+
+func (kv *KVStore) del(key string) (bool, error) {
+
+	if kv.replicas > 0 {
+		return kv.deleteReplicated(key)
+	}
 
 	var storage Storage
 	var migStorage Storage
+	var failover *FailoverPolicy
+	var hinted bool
 
 	kv.mu.Lock()
 
 	if kv.migration != nil {
 		shard := kv.migration.Choose(key)
 		migStorage = kv.mstorages[shard]
+	} else {
+		failover = kv.failover
+		hinted = kv.hasHints()
 	}
 	shard := kv.continuum.Choose(key)
 	storage = kv.storages[shard]
 
 	kv.mu.Unlock()
 
+	if failover != nil || hinted {
+		return kv.deleteFailover(key, shard, storage, failover)
+	}
+
 	var migOk bool
 	if migStorage != nil {
 		var err error
@@ -153,6 +261,10 @@ func (kv *KVStore) Delete(key string) (bool, error) {
 // ResetConnection implements Storage.ResetConnection()
 func (kv *KVStore) ResetConnection(key string) error {
 
+	if kv.replicas > 0 {
+		return kv.resetConnectionReplicated(key)
+	}
+
 	var storage Storage
 	var migStorage Storage
 
@@ -185,6 +297,16 @@ func (kv *KVStore) AddShard(shard string, storage Storage) {
 	kv.storages[shard] = storage
 }
 
+// Shard returns the storage for a shard, and a bool indicating if the shard is known
+func (kv *KVStore) Shard(shard string) (Storage, bool) {
+
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	storage, ok := kv.storages[shard]
+	return storage, ok
+}
+
 // DeleteShard removes a shard from the list of known shards
 func (kv *KVStore) DeleteShard(shard string) {
 
@@ -195,22 +317,35 @@ func (kv *KVStore) DeleteShard(shard string) {
 }
 
 // BeginMigration begins a continuum migration.  All the shards in the new
-// continuum must already be known to the KVStore via AddShard().
-func (kv *KVStore) BeginMigration(continuum Chooser) {
+// continuum must already be known to the KVStore via AddShard().  A
+// replicated KVStore returns an error if continuum isn't a ReplicaChooser
+// with enough buckets.
+func (kv *KVStore) BeginMigration(continuum Chooser) error {
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
+	if err := kv.checkMigration(continuum, len(continuum.Buckets())); err != nil {
+		return err
+	}
+
 	kv.migration = continuum
 	kv.mstorages = kv.storages
+
+	return nil
 }
 
-// BeginMigrationWithShards begins a continuum migration using the new set of shards.
-func (kv *KVStore) BeginMigrationWithShards(continuum Chooser, shards []Shard) {
+// BeginMigrationWithShards begins a continuum migration using the new set of
+// shards.  It returns an error in the same cases as BeginMigration.
+func (kv *KVStore) BeginMigrationWithShards(continuum Chooser, shards []Shard) error {
 
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
+	if err := kv.checkMigration(continuum, len(shards)); err != nil {
+		return err
+	}
+
 	var buckets []string
 	mstorages := make(map[string]Storage)
 	for _, shard := range shards {
@@ -222,6 +357,8 @@ func (kv *KVStore) BeginMigrationWithShards(continuum Chooser, shards []Shard) {
 
 	kv.migration = continuum
 	kv.mstorages = mstorages
+
+	return nil
 }
 
 // EndMigration ends a continuum migration and marks the migration continuum
@@ -233,6 +370,7 @@ func (kv *KVStore) EndMigration() {
 
 	kv.continuum = kv.migration
 	kv.migration = nil
+	kv.fallbacks = nil
 
 	kv.storages = kv.mstorages
 	kv.mstorages = nil
@@ -7,6 +7,11 @@ the backoff period has timed out.  It will then allow API calls to the storage
 engine again.  More fails will cause the backoff delay to grow, while a success
 resets the failure counter.
 
+Instead of (or as well as) counting consecutive failures, the storage can be
+marked as failed when too many of the recent requests have failed or been
+slow.  The backoff delays, their growth and jitter, and which errors count as
+failures are all configurable.
+
 This is useful in conjunction with the Replica storage backend so that failed
 replicas will fail immediately instead of causing API calls to take excessively
 long due to connect timeouts etc.
@@ -15,24 +20,59 @@ long due to connect timeouts etc.
 package backoff
 
 import (
+	"context"
 	"errors"
+	"math/rand"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dgryski/go-shardedkv"
 )
 
-type storageState int
+// State is the health of a storage backend, as tracked by Storage
+type State int
 
 const (
-	stateOK storageState = iota
-	stateWarn
-	stateFail
-	stateRetry
+	// StateOK means the storage is working
+	StateOK State = iota
+	// StateWarn means recent requests have failed, but not enough to stop using the storage
+	StateWarn
+	// StateFail means the storage has failed and requests are failing fast until NextRetry
+	StateFail
+	// StateRetry means the backoff period is over and probe requests are being allowed through
+	StateRetry
 )
 
+func (st State) String() string {
+	switch st {
+	case StateOK:
+		return "ok"
+	case StateWarn:
+		return "warn"
+	case StateFail:
+		return "fail"
+	case StateRetry:
+		return "retry"
+	}
+	return "State(" + strconv.Itoa(int(st)) + ")"
+}
+
 // The default maximum delay between retries
 const DefaultMaxDelay = 60
 
+// The default initial delay after a storage is marked as failed
+const DefaultBaseDelay = 1 * time.Second
+
+// The default factor the delay grows by after each failed retry
+const DefaultMultiplier = 2.0
+
+// The default number of recent requests used to compute ErrorRate and SlowCallRate
+const DefaultWindow = 100
+
+// The default number of requests allowed through while retrying a failed storage
+const DefaultMaxProbes = 1
+
 // Storage is a storage backend that tracks storage engine failures.
 type Storage struct {
 	// The underlying storage backend
@@ -41,84 +81,253 @@ type Storage struct {
 	MaxWarns int
 	// The maximum backoff time in seconds.  Default 60 seconds.
 	MaxDelay int
-
-	state     storageState
+	// The initial backoff time.  Default 1 second.
+	BaseDelay time.Duration
+	// The factor the backoff time is multiplied by after each failed retry.  Default 2.
+	Multiplier float64
+	// The fraction by which each backoff time is randomly adjusted up or
+	// down, to avoid clients retrying in lockstep.  0.1 means +/- 10%.
+	Jitter float64
+
+	// If non-zero, the storage is also marked as failed when the fraction
+	// of failed requests among the last Window requests reaches ErrorRate,
+	// or the fraction slower than SlowCall reaches SlowCallRate.  Rates
+	// aren't checked until MinRequests requests have been seen.
+	ErrorRate    float64
+	SlowCall     time.Duration
+	SlowCallRate float64
+	// The number of recent requests used to compute the rates.  Default 100.
+	Window      int
+	MinRequests int
+
+	// IsFailure reports whether an error from the storage should count as a
+	// failure.  Errors which aren't failures are returned to the caller but
+	// don't change the backoff state.  Default DefaultIsFailure.
+	IsFailure func(err error) bool
+
+	// OnStateChange, if set, is called after the storage moves from one
+	// state to another.  It may be called concurrently from several
+	// goroutines, and must not block.
+	OnStateChange func(from, to State)
+	// The maximum number of requests allowed through at once to probe a
+	// storage after the backoff period.  Other requests continue to fail
+	// fast until a probe succeeds.  Default 1.
+	MaxProbes int
+
+	mu        sync.Mutex
+	state     State
 	fails     int
-	delay     int
+	delay     time.Duration
 	skipUntil time.Time
+	probes    int
+	window    window
+	// set while a health checker is running; see StartHealthCheck
+	checking bool
 }
 
 // ErrBackingOff is the error returned if the package determines a storage backend is not currently suitable for use.
-var ErrBackingOff = errors.New("backing off")
+// It is classified as shardedkv.ErrUnavailable.
+var ErrBackingOff = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("backing off"))
 
 // for mocking during testing
 var timeNow = time.Now
+var randFloat64 = rand.Float64
+
+// DefaultIsFailure is the IsFailure function used if none is set.  Errors
+// caused by the request rather than the storage, such as
+// shardedkv.ErrNotFound, ErrConflict, ErrTooLarge and ErrInvalid, aren't
+// failures, and nor are requests shed locally with shardedkv.ErrRejected.
+func DefaultIsFailure(err error) bool {
+	return err != nil && !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, shardedkv.ErrNotFound) &&
+		!errors.Is(err, shardedkv.ErrConflict) &&
+		!errors.Is(err, shardedkv.ErrTooLarge) &&
+		!errors.Is(err, shardedkv.ErrInvalid) &&
+		!errors.Is(err, shardedkv.ErrRejected)
+}
+
+// unlock releases s.mu, and then calls OnStateChange if the state is no longer from
+func (s *Storage) unlock(from State) {
+
+	to := s.state
+	onStateChange := s.OnStateChange
+	s.mu.Unlock()
+
+	if onStateChange != nil && from != to {
+		onStateChange(from, to)
+	}
+}
+
+// State returns the current state of the storage
+func (s *Storage) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// NextRetry returns the time after which requests will be sent to a failed storage again.  It is the zero time if the storage hasn't failed.
+func (s *Storage) NextRetry() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skipUntil
+}
+
+// Failures returns the number of failed requests since the last success
+func (s *Storage) Failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fails
+}
 
-func (s *Storage) canUse() error {
+// canUse reports if a request may be sent to the storage.  probe is true if
+// the request is one of the limited number allowed through while retrying.
+func (s *Storage) canUse() (probe bool, err error) {
+
+	s.mu.Lock()
+	defer s.unlock(s.state)
 
 	switch s.state {
 
-	case stateOK, stateWarn:
-		return nil
+	case StateOK, StateWarn:
+		return false, nil
 
-	case stateRetry:
-		// panic("bad state transition")
+	case StateRetry:
+		maxProbes := s.MaxProbes
+		if maxProbes == 0 {
+			maxProbes = DefaultMaxProbes
+		}
+		if s.probes >= maxProbes {
+			return false, ErrBackingOff
+		}
+		s.probes++
+		return true, nil
 
-	case stateFail:
-		if timeNow().Before(s.skipUntil) {
-			return ErrBackingOff
+	case StateFail:
+		if s.checking || timeNow().Before(s.skipUntil) {
+			// the health checker is responsible for noticing when we've recovered
+			return false, ErrBackingOff
 		}
 
-		s.state = stateRetry
-		return nil
+		s.state = StateRetry
+		s.probes = 1
+		return true, nil
 
 	default:
 		// panic("bad transition")
 	}
 
-	return nil
+	return false, nil
 
 }
 
+// done records the result of a request which took elapsed
+func (s *Storage) done(probe bool, err error, elapsed time.Duration) {
+
+	s.mu.Lock()
+	defer s.unlock(s.state)
+
+	if probe && s.probes > 0 {
+		s.probes--
+	}
+
+	isFailure := s.IsFailure
+	if isFailure == nil {
+		isFailure = DefaultIsFailure
+	}
+
+	if err != nil && !isFailure(err) {
+		// not the storage's fault
+		return
+	}
+
+	if err != nil && !probe && s.state == StateRetry {
+		// this request was started before we began probing, so it doesn't tell us anything new
+		return
+	}
+
+	if s.ErrorRate > 0 || s.SlowCallRate > 0 {
+		size := s.Window
+		if size == 0 {
+			size = DefaultWindow
+		}
+		s.window.add(size, err != nil, s.SlowCall > 0 && elapsed >= s.SlowCall)
+	}
+
+	if err == nil {
+		s.success()
+	} else {
+		s.fail()
+	}
+
+	if (s.state == StateOK || s.state == StateWarn) && s.window.total >= s.MinRequests {
+		if (s.ErrorRate > 0 && s.window.errorRate() >= s.ErrorRate) ||
+			(s.SlowCallRate > 0 && s.window.slowRate() >= s.SlowCallRate) {
+			s.trip()
+		}
+	}
+}
+
+// fail and success must be called with s.mu held
 func (s *Storage) fail() {
 
 	switch s.state {
 
-	case stateOK:
-		s.state = stateWarn
+	case StateOK:
+		s.state = StateWarn
 		s.fails = 1
 
-	case stateWarn:
+	case StateWarn:
 		s.fails++
 		if s.MaxWarns == 0 || (s.MaxWarns >= 0 && s.fails == s.MaxWarns) {
-			s.state = stateFail
-			s.delay = 1
-			// FIXME(dgryski): possible to mock this for testing?
-			s.skipUntil = timeNow().Add(time.Duration(s.delay) * time.Second)
+			s.trip()
 		}
 
-	case stateFail:
+	case StateFail:
 		// panic("bad state transition")
 
-	case stateRetry:
-		s.state = stateFail
-		s.delay *= 2
-		maxDelay := s.MaxDelay
+	case StateRetry:
+		s.state = StateFail
+		s.fails++
+		multiplier := s.Multiplier
+		if multiplier == 0 {
+			multiplier = DefaultMultiplier
+		}
+		s.delay = time.Duration(float64(s.delay) * multiplier)
+		maxDelay := time.Duration(s.MaxDelay) * time.Second
 		if maxDelay == 0 {
-			maxDelay = DefaultMaxDelay
+			maxDelay = DefaultMaxDelay * time.Second
 		}
 		if s.delay >= maxDelay {
 			s.delay = maxDelay
 		}
-		s.skipUntil = timeNow().Add(time.Duration(s.delay) * time.Second)
+		s.skipUntil = timeNow().Add(s.jitter(s.delay))
 
 	default:
 		// panic("unknown state")
 	}
 }
 
+// trip marks the storage as failed for the initial backoff period
+func (s *Storage) trip() {
+	s.state = StateFail
+	s.delay = s.BaseDelay
+	if s.delay == 0 {
+		s.delay = DefaultBaseDelay
+	}
+	s.skipUntil = timeNow().Add(s.jitter(s.delay))
+	s.window.reset()
+}
+
+// jitter randomly adjusts d by up to s.Jitter in either direction
+func (s *Storage) jitter(d time.Duration) time.Duration {
+	if s.Jitter == 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + s.Jitter*(2*randFloat64()-1)))
+}
+
 func (s *Storage) success() {
-	s.state = stateOK
+	s.state = StateOK
 	s.fails = 0
 	s.delay = 0
 	s.skipUntil = time.Time{}
@@ -127,19 +336,16 @@ func (s *Storage) success() {
 // Get implements the shardedkv.Storage interface
 func (s *Storage) Get(key string) ([]byte, bool, error) {
 
-	err := s.canUse()
+	probe, err := s.canUse()
 
 	if err != nil {
 		return nil, false, err
 	}
 
+	start := timeNow()
 	val, ok, err := s.Store.Get(key)
 
-	if err == nil {
-		s.success()
-	} else {
-		s.fail()
-	}
+	s.done(probe, err, timeNow().Sub(start))
 
 	return val, ok, err
 }
@@ -147,19 +353,16 @@ func (s *Storage) Get(key string) ([]byte, bool, error) {
 // Set implements the shardedkv.Storage interface
 func (s *Storage) Set(key string, value []byte) error {
 
-	err := s.canUse()
+	probe, err := s.canUse()
 
 	if err != nil {
 		return err
 	}
 
+	start := timeNow()
 	err = s.Store.Set(key, value)
 
-	if err == nil {
-		s.success()
-	} else {
-		s.fail()
-	}
+	s.done(probe, err, timeNow().Sub(start))
 
 	return err
 }
@@ -167,19 +370,16 @@ func (s *Storage) Set(key string, value []byte) error {
 // Delete implements the shardedkv.Storage interface
 func (s *Storage) Delete(key string) (bool, error) {
 
-	err := s.canUse()
+	probe, err := s.canUse()
 
 	if err != nil {
 		return false, err
 	}
 
+	start := timeNow()
 	ok, err := s.Store.Delete(key)
 
-	if err == nil {
-		s.success()
-	} else {
-		s.fail()
-	}
+	s.done(probe, err, timeNow().Sub(start))
 
 	return ok, err
 }
@@ -191,7 +391,11 @@ func (s *Storage) ResetConnection(key string) error {
 
 	// reset the failure counters
 	// assume after resetting everything will work
+	s.mu.Lock()
+	from := s.state
 	s.success()
+	s.probes = 0
+	s.unlock(from)
 
 	return err
 }
@@ -1,6 +1,12 @@
 package backoff
 
 import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -40,3 +46,342 @@ func TestError(t *testing.T) {
 }
 
 var _ shardedkv.Storage = &Storage{}
+
+// a storage that fails until released, and then blocks gets until unblocked
+type gatedStore struct {
+	storagetest.Errstore
+	mu      sync.Mutex
+	healthy bool
+	unblock chan struct{}
+}
+
+func (g *gatedStore) Get(key string) ([]byte, bool, error) {
+	g.mu.Lock()
+	healthy := g.healthy
+	g.mu.Unlock()
+	if !healthy {
+		return g.Errstore.Get(key)
+	}
+	<-g.unblock
+	return nil, false, nil
+}
+
+func TestProbes(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	timeNow = time.Now
+
+	g := &gatedStore{unblock: make(chan struct{})}
+	b := &Storage{Store: g, MaxWarns: 2}
+
+	b.Get("foo")
+	b.Get("foo")
+	if _, _, err := b.Get("foo"); err != ErrBackingOff {
+		t.Fatalf("storage not backing off: got %v", err)
+	}
+
+	g.mu.Lock()
+	g.healthy = true
+	g.mu.Unlock()
+	timeNow = func() time.Time { return time.Now().Add(10 * time.Second) }
+
+	probe := make(chan error)
+	go func() {
+		_, _, err := b.Get("foo")
+		probe <- err
+	}()
+
+	// wait for the probe to be let through
+	for {
+		b.mu.Lock()
+		probes := b.probes
+		b.mu.Unlock()
+		if probes == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, _, err := b.Get("foo"); err != ErrBackingOff {
+		t.Errorf("second request allowed through while probing: got %v", err)
+	}
+
+	close(g.unblock)
+	if err := <-probe; err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+
+	if _, _, err := b.Get("foo"); err != nil {
+		t.Errorf("request failed after successful probe: %v", err)
+	}
+}
+
+// a storage that fails every other request
+type flakyStore struct {
+	*memory.Storage
+	n int32
+}
+
+func (f *flakyStore) Get(key string) ([]byte, bool, error) {
+	if atomic.AddInt32(&f.n, 1)%2 == 0 {
+		return nil, false, errors.New("flaky storage get")
+	}
+	return f.Storage.Get(key)
+}
+
+func TestConcurrent(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	timeNow = time.Now
+
+	b := &Storage{Store: &flakyStore{Storage: memory.New()}, MaxWarns: 2, MaxProbes: 2}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				b.Set("foo", []byte("bar"))
+				b.Get("foo")
+				b.Delete("foo")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// a storage that returns err from every Get
+type errGetStore struct {
+	*memory.Storage
+	err error
+}
+
+func (e errGetStore) Get(key string) ([]byte, bool, error) { return nil, false, e.err }
+
+func TestErrorRate(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	timeNow = time.Now
+
+	m := memory.New()
+	b := &Storage{Store: m, MaxWarns: -1, ErrorRate: 0.5, Window: 10, MinRequests: 10}
+
+	// 6 successes and 3 failures shouldn't trip
+	for i := 0; i < 6; i++ {
+		b.Set("foo", []byte("bar"))
+	}
+	b.Store = errGetStore{Storage: m, err: errors.New("get failed")}
+	for i := 0; i < 3; i++ {
+		b.Get("foo")
+	}
+	if _, _, err := b.Get("foo"); err == ErrBackingOff {
+		t.Fatalf("backing off below the error rate")
+	}
+
+	// the next failure takes us to 5 of 10
+	if _, _, err := b.Get("foo"); err == ErrBackingOff {
+		t.Fatalf("backing off before the failing request")
+	}
+	if _, _, err := b.Get("foo"); err != ErrBackingOff {
+		t.Errorf("not backing off at the error rate: got %v", err)
+	}
+}
+
+func TestSlowCallRate(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	now := time.Now()
+	timeNow = func() time.Time {
+		// every call to timeNow advances the clock, so each request takes 10ms
+		now = now.Add(10 * time.Millisecond)
+		return now
+	}
+
+	b := &Storage{Store: memory.New(), SlowCall: 10 * time.Millisecond, SlowCallRate: 1, MinRequests: 3}
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := b.Get("foo"); err != nil {
+			t.Fatalf("error from get %d: %v", i, err)
+		}
+	}
+
+	if _, _, err := b.Get("foo"); err != ErrBackingOff {
+		t.Errorf("not backing off at the slow call rate: got %v", err)
+	}
+}
+
+func TestIsFailure(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	timeNow = time.Now
+
+	b := &Storage{Store: errGetStore{Storage: memory.New(), err: context.Canceled}}
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.Get("foo"); err != context.Canceled {
+			t.Fatalf("cancelled request returned %v", err)
+		}
+	}
+
+	b = &Storage{Store: errGetStore{Storage: memory.New(), err: shardedkv.NewError(shardedkv.ErrNotFound, errors.New("no such key"))}}
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.Get("foo"); !errors.Is(err, shardedkv.ErrNotFound) {
+			t.Fatalf("not-found error caused backoff: %v", err)
+		}
+	}
+
+	if !errors.Is(ErrBackingOff, shardedkv.ErrUnavailable) {
+		t.Errorf("ErrBackingOff isn't classified as unavailable")
+	}
+
+	if DefaultIsFailure(shardedkv.NewError(shardedkv.ErrRejected, errors.New("shed"))) {
+		t.Errorf("a locally rejected request counts as a failure")
+	}
+
+	if DefaultIsFailure(shardedkv.NewError(shardedkv.ErrInvalid, errors.New("bad key"))) {
+		t.Errorf("an invalid request counts as a failure")
+	}
+
+	notFound := errors.New("not found")
+	b = &Storage{
+		Store:     errGetStore{Storage: memory.New(), err: notFound},
+		IsFailure: func(err error) bool { return err != notFound },
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, _, err := b.Get("foo"); err != notFound {
+			t.Fatalf("ignored error caused backoff: %v", err)
+		}
+	}
+}
+
+func TestDelays(t *testing.T) {
+	defer func() { timeNow, randFloat64 = time.Now, rand.Float64 }()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	randFloat64 = func() float64 { return 1 }
+
+	b := &Storage{
+		Store:      storagetest.Errstore{},
+		BaseDelay:  100 * time.Millisecond,
+		Multiplier: 3,
+		Jitter:     0.1,
+	}
+
+	b.Get("foo")
+	b.Get("foo")
+
+	if want := now.Add(110 * time.Millisecond); !b.skipUntil.Equal(want) {
+		t.Errorf("skipUntil=%v, want %v", b.skipUntil, want)
+	}
+
+	now = now.Add(time.Second)
+	b.Get("foo")
+
+	if want := now.Add(330 * time.Millisecond); !b.skipUntil.Equal(want) {
+		t.Errorf("skipUntil after retry=%v, want %v", b.skipUntil, want)
+	}
+}
+
+func TestStateChange(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	var transitions []string
+	b := &Storage{
+		Store:    storagetest.Errstore{},
+		MaxWarns: 2,
+		OnStateChange: func(from, to State) {
+			transitions = append(transitions, from.String()+"->"+to.String())
+		},
+	}
+
+	if st := b.State(); st != StateOK {
+		t.Errorf("initial state=%v, want %v", st, StateOK)
+	}
+
+	b.Get("foo")
+	b.Get("foo")
+
+	if st := b.State(); st != StateFail {
+		t.Errorf("state=%v, want %v", st, StateFail)
+	}
+	if f := b.Failures(); f != 2 {
+		t.Errorf("Failures()=%d, want 2", f)
+	}
+	if r := b.NextRetry(); !r.Equal(now.Add(time.Second)) {
+		t.Errorf("NextRetry()=%v, want %v", r, now.Add(time.Second))
+	}
+
+	now = now.Add(2 * time.Second)
+	b.Store = memory.New()
+	b.Get("foo")
+
+	if st := b.State(); st != StateOK {
+		t.Errorf("state after successful retry=%v, want %v", st, StateOK)
+	}
+
+	want := []string{"ok->warn", "warn->fail", "fail->retry", "retry->ok"}
+	if strings.Join(transitions, " ") != strings.Join(want, " ") {
+		t.Errorf("transitions=%v, want %v", transitions, want)
+	}
+}
+
+// a storage whose health is controlled by the test
+type pingStore struct {
+	storagetest.Errstore
+	mu      sync.Mutex
+	healthy bool
+	pings   int
+}
+
+func (p *pingStore) Ping() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pings++
+	if !p.healthy {
+		return errors.New("ping failed")
+	}
+	return nil
+}
+
+func TestHealthCheck(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+
+	p := &pingStore{}
+	b := &Storage{Store: p}
+
+	stop := b.StartHealthCheck(time.Millisecond, nil)
+	defer stop()
+
+	b.Get("foo")
+	b.Get("foo")
+
+	// even after the backoff period, user requests shouldn't be used to probe
+	now = now.Add(time.Hour)
+	if _, _, err := b.Get("foo"); err != ErrBackingOff {
+		t.Errorf("request let through while health checking: got %v", err)
+	}
+
+	p.mu.Lock()
+	p.healthy = true
+	p.mu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.State() != StateOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("health checker didn't mark the storage as recovered")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	p.mu.Lock()
+	if p.pings == 0 {
+		t.Errorf("health checker didn't use Ping")
+	}
+	p.mu.Unlock()
+}
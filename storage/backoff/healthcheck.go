@@ -0,0 +1,78 @@
+package backoff
+
+import (
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+// HealthCheckKey is the key fetched by DefaultCheck from storages which don't implement shardedkv.Pinger
+const HealthCheckKey = "shardedkv-health-check"
+
+// DefaultCheck pings store if it implements shardedkv.Pinger, and otherwise fetches HealthCheckKey.
+func DefaultCheck(store shardedkv.Storage) error {
+	if p, ok := store.(shardedkv.Pinger); ok {
+		return p.Ping()
+	}
+
+	_, _, err := store.Get(HealthCheckKey)
+	return err
+}
+
+// StartHealthCheck starts a goroutine which checks a failed storage every
+// interval, and marks it as working again once check succeeds.  While the
+// health checker is running, requests fail fast until it sees the storage
+// recover instead of being used to probe it.  If check is nil, DefaultCheck
+// is used.  Call the returned function to stop the health checker.
+func (s *Storage) StartHealthCheck(interval time.Duration, check func(store shardedkv.Storage) error) (stop func()) {
+
+	if check == nil {
+		check = DefaultCheck
+	}
+
+	s.mu.Lock()
+	s.checking = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				s.healthCheck(check)
+			}
+		}
+	}()
+
+	return func() {
+		ticker.Stop()
+		close(done)
+
+		s.mu.Lock()
+		s.checking = false
+		s.mu.Unlock()
+	}
+}
+
+// healthCheck checks the storage, if it has failed
+func (s *Storage) healthCheck(check func(store shardedkv.Storage) error) {
+
+	if st := s.State(); st != StateFail && st != StateRetry {
+		return
+	}
+
+	err := check(s.Store)
+
+	s.mu.Lock()
+	from := s.state
+	if err == nil {
+		s.success()
+	} else {
+		s.fails++
+	}
+	s.unlock(from)
+}
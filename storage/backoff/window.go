@@ -0,0 +1,67 @@
+package backoff
+
+// window is a sliding window over the outcomes of the most recent requests
+type window struct {
+	failed []bool
+	slow   []bool
+	next   int
+
+	total int
+	fails int
+	slows int
+}
+
+// add records the outcome of a request in a window holding the last size requests
+func (w *window) add(size int, failed, slow bool) {
+
+	if len(w.failed) != size {
+		w.failed = make([]bool, size)
+		w.slow = make([]bool, size)
+		w.next, w.total, w.fails, w.slows = 0, 0, 0, 0
+	}
+
+	if w.total == size {
+		// drop the oldest outcome
+		if w.failed[w.next] {
+			w.fails--
+		}
+		if w.slow[w.next] {
+			w.slows--
+		}
+	} else {
+		w.total++
+	}
+
+	w.failed[w.next] = failed
+	w.slow[w.next] = slow
+	if failed {
+		w.fails++
+	}
+	if slow {
+		w.slows++
+	}
+
+	w.next = (w.next + 1) % size
+}
+
+func (w *window) reset() {
+	for i := range w.failed {
+		w.failed[i] = false
+		w.slow[i] = false
+	}
+	w.next, w.total, w.fails, w.slows = 0, 0, 0, 0
+}
+
+func (w *window) errorRate() float64 {
+	if w.total == 0 {
+		return 0
+	}
+	return float64(w.fails) / float64(w.total)
+}
+
+func (w *window) slowRate() float64 {
+	if w.total == 0 {
+		return 0
+	}
+	return float64(w.slows) / float64(w.total)
+}
@@ -2,15 +2,34 @@
 package fs
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"path"
+	"syscall"
+
+	"github.com/dgryski/go-shardedkv"
 )
 
 type Storage struct {
 	dir string
 }
 
+// wrapError classifies a file system error with the shardedkv error kinds
+func wrapError(err error) error {
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EFBIG) || errors.Is(err, syscall.ENAMETOOLONG):
+		return shardedkv.NewError(shardedkv.ErrTooLarge, err)
+	case errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EROFS):
+		return shardedkv.NewError(shardedkv.ErrUnavailable, err)
+	}
+
+	return err
+}
+
 // New returns a new Storage, storing files in 'dir'
 func New(dir string) *Storage {
 	return &Storage{
@@ -26,7 +45,7 @@ func (s *Storage) Get(key string) ([]byte, bool, error) {
 	}
 
 	if err != nil {
-		return nil, false, err
+		return nil, false, wrapError(err)
 	}
 
 	return val, true, nil
@@ -34,7 +53,7 @@ func (s *Storage) Get(key string) ([]byte, bool, error) {
 
 func (s *Storage) Set(key string, val []byte) error {
 	err := ioutil.WriteFile(path.Join(s.dir, key), val, 0777)
-	return err
+	return wrapError(err)
 }
 
 func (s *Storage) Delete(key string) (bool, error) {
@@ -46,7 +65,7 @@ func (s *Storage) Delete(key string) (bool, error) {
 	}
 
 	if err != nil {
-		return false, err
+		return false, wrapError(err)
 	}
 
 	return true, nil
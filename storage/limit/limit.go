@@ -0,0 +1,209 @@
+// Package limit implements a storage backend that limits the request rate and concurrency of another backend.
+/*
+
+Requests are limited by a token bucket, allowing Rate requests per second
+with bursts of up to Burst, and by the number of requests in flight at once.
+A request which would exceed a limit either waits up to Timeout for capacity,
+or fails immediately with ErrLimited if Timeout is zero.
+
+Limits are per-backend.  To configure them per shard of a KVStore, wrap the
+shards with Shards before passing them to shardedkv.New.
+
+*/
+package limit
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+// ErrLimited is returned when a request would exceed the storage's rate or
+// concurrency limit.  It is classified as shardedkv.ErrRejected.
+var ErrLimited = shardedkv.NewError(shardedkv.ErrRejected, errors.New("limit: storage request limit exceeded"))
+
+// Limits configures a Storage
+type Limits struct {
+	// The maximum sustained requests per second.  Zero means unlimited.
+	Rate float64
+	// The maximum number of requests allowed at once above Rate.  Default is Rate, but at least 1.
+	Burst int
+	// The maximum number of requests in flight at once.  Zero means unlimited.
+	MaxInFlight int
+	// How long a request may wait for capacity before failing with ErrLimited.  Zero means fail fast.
+	Timeout time.Duration
+}
+
+// Storage is a storage backend that limits the requests sent to another
+type Storage struct {
+	store shardedkv.Storage
+
+	mu     sync.Mutex
+	limits Limits
+	tokens float64
+	last   time.Time
+	sem    chan struct{}
+}
+
+// for mocking during testing
+var timeNow = time.Now
+var sleep = time.Sleep
+
+// New returns a Storage that limits requests to store
+func New(store shardedkv.Storage, limits Limits) *Storage {
+	s := &Storage{store: store}
+	s.SetLimits(limits)
+	return s
+}
+
+// Shards returns a copy of shards where each shard named in limits is wrapped in a Storage with those limits
+func Shards(shards []shardedkv.Shard, limits map[string]Limits) []shardedkv.Shard {
+
+	wrapped := make([]shardedkv.Shard, len(shards))
+
+	for i, shard := range shards {
+		wrapped[i] = shard
+		if l, ok := limits[shard.Name]; ok {
+			wrapped[i].Backend = New(shard.Backend, l)
+		}
+	}
+
+	return wrapped
+}
+
+// SetLimits changes the limits.  Requests already waiting or in flight are unaffected.
+func (s *Storage) SetLimits(limits Limits) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if limits.Burst == 0 {
+		limits.Burst = int(math.Max(1, math.Ceil(limits.Rate)))
+	}
+
+	s.limits = limits
+	s.tokens = float64(limits.Burst)
+	s.last = timeNow()
+
+	s.sem = nil
+	if limits.MaxInFlight > 0 {
+		s.sem = make(chan struct{}, limits.MaxInFlight)
+	}
+}
+
+// Limits returns the current limits
+func (s *Storage) Limits() Limits {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.limits
+}
+
+// acquire waits for capacity to send a request.  If it succeeds, release must be called when the request is finished.
+func (s *Storage) acquire() (release func(), err error) {
+
+	s.mu.Lock()
+	limits, sem := s.limits, s.sem
+	s.mu.Unlock()
+
+	start := timeNow()
+	release = func() {}
+
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			if limits.Timeout == 0 {
+				return nil, ErrLimited
+			}
+
+			timer := time.NewTimer(limits.Timeout)
+			select {
+			case sem <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				return nil, ErrLimited
+			}
+		}
+
+		release = func() { <-sem }
+	}
+
+	if limits.Rate <= 0 {
+		return release, nil
+	}
+
+	s.mu.Lock()
+
+	now := timeNow()
+	s.tokens += now.Sub(s.last).Seconds() * s.limits.Rate
+	if burst := float64(s.limits.Burst); s.tokens > burst {
+		s.tokens = burst
+	}
+	s.last = now
+
+	if s.tokens >= 1 {
+		s.tokens--
+		s.mu.Unlock()
+		return release, nil
+	}
+
+	// wait for the next token, if we have time
+	wait := time.Duration((1 - s.tokens) / s.limits.Rate * float64(time.Second))
+	if now.Add(wait).Sub(start) > limits.Timeout {
+		s.mu.Unlock()
+		release()
+		return nil, ErrLimited
+	}
+
+	// take the token now so later requests queue up behind us
+	s.tokens--
+	s.mu.Unlock()
+
+	sleep(wait)
+
+	return release, nil
+}
+
+// Get implements the shardedkv.Storage interface
+func (s *Storage) Get(key string) ([]byte, bool, error) {
+
+	release, err := s.acquire()
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	return s.store.Get(key)
+}
+
+// Set implements the shardedkv.Storage interface
+func (s *Storage) Set(key string, value []byte) error {
+
+	release, err := s.acquire()
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return s.store.Set(key, value)
+}
+
+// Delete implements the shardedkv.Storage interface
+func (s *Storage) Delete(key string) (bool, error) {
+
+	release, err := s.acquire()
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	return s.store.Delete(key)
+}
+
+// ResetConnection implements the shardedkv.Storage interface.  It isn't subject to the limits.
+func (s *Storage) ResetConnection(key string) error {
+	return s.store.ResetConnection(key)
+}
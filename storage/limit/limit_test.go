@@ -0,0 +1,132 @@
+package limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/choosers/chash"
+	"github.com/dgryski/go-shardedkv/storage/memory"
+	"github.com/dgryski/go-shardedkv/storagetest"
+)
+
+// a storage whose gets block until released
+type blockingStore struct {
+	*memory.Storage
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) Get(key string) ([]byte, bool, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return b.Storage.Get(key)
+}
+
+func TestLimit(t *testing.T) {
+	s := New(memory.New(), Limits{Rate: 1000, MaxInFlight: 10})
+	storagetest.StorageTest(t, s)
+}
+
+func TestMaxInFlight(t *testing.T) {
+
+	b := &blockingStore{Storage: memory.New(), started: make(chan struct{}), release: make(chan struct{})}
+	s := New(b, Limits{MaxInFlight: 1})
+
+	done := make(chan struct{})
+	go func() {
+		s.Get("foo")
+		done <- struct{}{}
+	}()
+	<-b.started
+
+	if _, _, err := s.Get("foo"); err != ErrLimited {
+		t.Errorf("request over concurrency limit: got %v, want ErrLimited", err)
+	}
+
+	b.release <- struct{}{}
+	<-done
+
+	s.SetLimits(Limits{MaxInFlight: 1, Timeout: 5 * time.Second})
+
+	go func() {
+		s.Get("foo")
+		done <- struct{}{}
+	}()
+	<-b.started
+
+	// this one should wait for the request in flight instead of failing
+	waited := make(chan error)
+	go func() {
+		_, _, err := s.Get("foo")
+		waited <- err
+	}()
+
+	b.release <- struct{}{}
+	<-done
+	<-b.started
+	b.release <- struct{}{}
+
+	if err := <-waited; err != nil {
+		t.Errorf("queued request failed: %v", err)
+	}
+}
+
+func TestRate(t *testing.T) {
+	defer func() { timeNow, sleep = time.Now, time.Sleep }()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	var slept time.Duration
+	sleep = func(d time.Duration) { slept += d }
+
+	s := New(memory.New(), Limits{Rate: 10, Burst: 2})
+
+	for i := 0; i < 2; i++ {
+		if _, _, err := s.Get("foo"); err != nil {
+			t.Fatalf("request %d within burst failed: %v", i, err)
+		}
+	}
+
+	if _, _, err := s.Get("foo"); err != ErrLimited {
+		t.Errorf("request over rate limit: got %v, want ErrLimited", err)
+	}
+
+	now = now.Add(100 * time.Millisecond)
+	if _, _, err := s.Get("foo"); err != nil {
+		t.Errorf("request after refill failed: %v", err)
+	}
+
+	s.SetLimits(Limits{Rate: 10, Burst: 1, Timeout: time.Second})
+	s.Get("foo")
+	if _, _, err := s.Get("foo"); err != nil {
+		t.Errorf("queued request failed: %v", err)
+	}
+	if slept != 100*time.Millisecond {
+		t.Errorf("queued request waited %v, want 100ms", slept)
+	}
+}
+
+func TestShards(t *testing.T) {
+
+	shards := []shardedkv.Shard{
+		{Name: "shard1", Backend: memory.New()},
+		{Name: "shard2", Backend: memory.New()},
+	}
+
+	kv := shardedkv.New(chash.New(), Shards(shards, map[string]Limits{"shard2": {MaxInFlight: 5}}))
+
+	s, ok := kv.Shard("shard2")
+	if _, limited := s.(*Storage); !ok || !limited {
+		t.Errorf("shard2 not limited: %T", s)
+	}
+
+	s, ok = kv.Shard("shard1")
+	if _, limited := s.(*Storage); !ok || limited {
+		t.Errorf("shard1 limited: %T", s)
+	}
+
+	storagetest.StorageTest(t, kv)
+}
+
+var _ shardedkv.Storage = &Storage{}
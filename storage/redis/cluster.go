@@ -0,0 +1,265 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/garyburd/redigo/redis"
+)
+
+// number of hash slots in a Redis Cluster
+const numSlots = 16384
+
+// the number of MOVED or ASK redirections followed for one request
+const maxRedirects = 5
+
+// ErrNoSlots is returned when none of the cluster nodes return the slot map
+var ErrNoSlots = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("redis: can't load cluster slots"))
+
+type cluster struct {
+	seeds []string
+
+	mu    sync.Mutex
+	slots [numSlots]string
+	pools map[string]*redis.Pool
+}
+
+// NewCluster returns a new storage backed by a Redis Cluster.  The slot map
+// is loaded from the first of the seed nodes that responds, and updated as
+// the nodes redirect requests.  Only database 0 is available in a cluster, so
+// opts.DB is ignored.
+func NewCluster(seeds []string, opts Options) (*Storage, error) {
+
+	opts.DB = 0
+
+	s := newStorage(opts)
+	s.cluster = &cluster{seeds: seeds, pools: make(map[string]*redis.Pool)}
+
+	if err := s.loadSlots(); err != nil {
+		s.closeCluster()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// keySlot returns the cluster hash slot for key
+func keySlot(key string) int {
+
+	// only the hash tag is hashed, if there is one
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key) % numSlots)
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// nodePool returns the connection pool for a cluster node
+func (s *Storage) nodePool(addr string) *redis.Pool {
+
+	c := s.cluster
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.pools[addr]
+	if !ok {
+		p = s.newPool(addr)
+		c.pools[addr] = p
+	}
+
+	return p
+}
+
+// loadSlots loads the slot map from the first node that responds, trying the seeds first
+func (s *Storage) loadSlots() error {
+
+	c := s.cluster
+
+	c.mu.Lock()
+	nodes := append([]string(nil), c.seeds...)
+	seen := make(map[string]bool)
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	err := ErrNoSlots
+
+	for _, addr := range nodes {
+
+		conn := s.nodePool(addr).Get()
+		repl, rerr := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+
+		if rerr != nil {
+			err = wrapError(rerr)
+			continue
+		}
+
+		slots, perr := parseSlots(repl, addr)
+		if perr != nil {
+			err = perr
+			continue
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	return err
+}
+
+// parseSlots parses a CLUSTER SLOTS reply from the node at addr
+func parseSlots(repl []interface{}, addr string) ([numSlots]string, error) {
+
+	var slots [numSlots]string
+
+	for _, r := range repl {
+
+		entry, err := redis.Values(r, nil)
+		if err != nil || len(entry) < 3 {
+			return slots, errors.New("redis: bad CLUSTER SLOTS reply")
+		}
+
+		start, _ := redis.Int(entry[0], nil)
+		end, _ := redis.Int(entry[1], nil)
+
+		// the first node listed is the primary
+		node, err := redis.Values(entry[2], nil)
+		if err != nil || len(node) < 2 || start < 0 || end >= numSlots {
+			return slots, errors.New("redis: bad CLUSTER SLOTS reply")
+		}
+
+		host, _ := redis.String(node[0], nil)
+		port, _ := redis.Int(node[1], nil)
+
+		// an empty host means the node that sent the reply
+		if host == "" {
+			host, _, _ = net.SplitHostPort(addr)
+		}
+
+		for i := start; i <= end; i++ {
+			slots[i] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+
+	return slots, nil
+}
+
+// parseRedirect parses a MOVED or ASK error
+func parseRedirect(err error) (ask bool, slot int, addr string, ok bool) {
+
+	rerr, isRedis := err.(redis.Error)
+	if !isRedis {
+		return false, 0, "", false
+	}
+
+	fields := strings.Fields(string(rerr))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return false, 0, "", false
+	}
+
+	slot, serr := strconv.Atoi(fields[1])
+	if serr != nil || slot < 0 || slot >= numSlots {
+		return false, 0, "", false
+	}
+
+	return fields[0] == "ASK", slot, fields[2], true
+}
+
+// nodeAddr returns the address of the node serving key
+func (s *Storage) nodeAddr(key string) string {
+
+	c := s.cluster
+
+	c.mu.Lock()
+	addr := c.slots[keySlot(key)]
+	c.mu.Unlock()
+
+	if addr == "" && len(c.seeds) > 0 {
+		// the slot isn't covered; any node will redirect us
+		addr = c.seeds[0]
+	}
+
+	return addr
+}
+
+// runCluster calls f with a connection to the node serving key, following redirections
+func (s *Storage) runCluster(key string, f func(conn redis.Conn) (interface{}, error)) (interface{}, error) {
+
+	c := s.cluster
+	addr := s.nodeAddr(key)
+
+	var asking bool
+
+	for i := 0; ; i++ {
+
+		conn := s.nodePool(addr).Get()
+		if asking {
+			conn.Send("ASKING")
+		}
+		repl, err := f(conn)
+		conn.Close()
+
+		ask, slot, raddr, redirected := parseRedirect(err)
+		if !redirected || i == maxRedirects {
+			return repl, err
+		}
+
+		if !ask {
+			// the slot has moved for good
+			c.mu.Lock()
+			c.slots[slot] = raddr
+			c.mu.Unlock()
+		}
+
+		asking = ask
+		addr = raddr
+	}
+}
+
+func (s *Storage) closeCluster() error {
+
+	c := s.cluster
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err error
+	for _, p := range c.pools {
+		if cerr := p.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
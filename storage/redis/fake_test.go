@@ -0,0 +1,475 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeError is an error reply from a fakeRedis
+type fakeError string
+
+// status is a simple string reply from a fakeRedis
+type status string
+
+// fakeRedis is an in-process redis server implementing just enough commands for the tests
+type fakeRedis struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	password string
+	dbs      map[int]map[string]interface{} // values are []byte or map[string][]byte
+	accepted int
+	open     map[net.Conn]bool
+	flushes  int // the number of times replies were sent
+
+	// if this is a sentinel, the addresses of the primaries it knows
+	masters map[string]string
+	// if this is a cluster node, the cluster it belongs to
+	cluster *fakeCluster
+}
+
+// fakeConn is the state of one client connection
+type fakeConn struct {
+	authed bool
+	db     int
+	multi  bool
+	queued [][]string
+	asking bool
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	f := &fakeRedis{
+		ln:   ln,
+		dbs:  make(map[int]map[string]interface{}),
+		open: make(map[net.Conn]bool),
+	}
+
+	go f.serve()
+	t.Cleanup(f.close)
+
+	return f
+}
+
+func (f *fakeRedis) addr() string { return f.ln.Addr().String() }
+
+func (f *fakeRedis) close() {
+	f.ln.Close()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.open {
+		c.Close()
+	}
+}
+
+// connections returns the number of connections accepted and still open
+func (f *fakeRedis) connections() (accepted, open int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accepted, len(f.open)
+}
+
+// roundTrips returns the number of times replies were sent
+func (f *fakeRedis) roundTrips() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.flushes
+}
+
+// dropAll closes all the client connections, as if the server had restarted
+func (f *fakeRedis) dropAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for c := range f.open {
+		c.Close()
+	}
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		f.mu.Lock()
+		f.accepted++
+		f.open[c] = true
+		f.mu.Unlock()
+
+		go f.handle(c)
+	}
+}
+
+func (f *fakeRedis) handle(c net.Conn) {
+
+	defer func() {
+		c.Close()
+		f.mu.Lock()
+		delete(f.open, c)
+		f.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	state := &fakeConn{}
+
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		writeReply(w, f.command(state, args))
+
+		// flush once all the pipelined commands have been handled
+		if r.Buffered() == 0 {
+			f.mu.Lock()
+			f.flushes++
+			f.mu.Unlock()
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *fakeRedis) command(state *fakeConn, args []string) interface{} {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := strings.ToUpper(args[0])
+
+	if cmd == "AUTH" {
+		if len(args) != 2 || args[1] != f.password {
+			return fakeError("ERR invalid password")
+		}
+		state.authed = true
+		return status("OK")
+	}
+
+	if f.password != "" && !state.authed {
+		return fakeError("NOAUTH Authentication required.")
+	}
+
+	if cmd == "ASKING" {
+		state.asking = true
+		return status("OK")
+	}
+
+	// ASKING only applies to the next command
+	defer func() { state.asking = false }()
+
+	switch {
+	case cmd == "MULTI":
+		state.multi = true
+		return status("OK")
+
+	case cmd == "EXEC":
+		replies := []interface{}{}
+		for _, args := range state.queued {
+			replies = append(replies, f.run(state, strings.ToUpper(args[0]), args))
+		}
+		state.multi, state.queued = false, nil
+		return replies
+
+	case state.multi:
+		state.queued = append(state.queued, args)
+		return status("QUEUED")
+	}
+
+	return f.run(state, cmd, args)
+}
+
+var wrongType = fakeError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// run runs a single command with the lock held
+func (f *fakeRedis) run(state *fakeConn, cmd string, args []string) interface{} {
+
+	db := f.dbs[state.db]
+	if db == nil {
+		db = make(map[string]interface{})
+		f.dbs[state.db] = db
+	}
+
+	if f.cluster != nil {
+		if redirect := f.cluster.route(f, state, cmd, args, db); redirect != nil {
+			return redirect
+		}
+	}
+
+	switch cmd {
+	case "PING":
+		return status("PONG")
+
+	case "SENTINEL":
+		addr, ok := f.masters[args[2]]
+		if strings.ToLower(args[1]) != "get-master-addr-by-name" || !ok {
+			return nil
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return []interface{}{host, port}
+
+	case "CLUSTER":
+		if f.cluster == nil || strings.ToUpper(args[1]) != "SLOTS" {
+			return fakeError("ERR This instance has cluster support disabled")
+		}
+		return f.cluster.slots()
+
+	case "SELECT":
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fakeError("ERR invalid DB index")
+		}
+		state.db = n
+		return status("OK")
+
+	case "GET":
+		v, ok := db[args[1]]
+		if !ok {
+			return nil
+		}
+		if _, ok := v.([]byte); !ok {
+			return wrongType
+		}
+		return v
+
+	case "HGET":
+		v, ok := db[args[1]]
+		if !ok {
+			return nil
+		}
+		h, ok := v.(map[string][]byte)
+		if !ok {
+			return wrongType
+		}
+		if fv, ok := h[args[2]]; ok {
+			return fv
+		}
+		return nil
+
+	case "HGETALL":
+		v, ok := db[args[1]]
+		if !ok {
+			return []interface{}{}
+		}
+		h, ok := v.(map[string][]byte)
+		if !ok {
+			return wrongType
+		}
+		var reply []interface{}
+		for k, fv := range h {
+			reply = append(reply, k, fv)
+		}
+		return reply
+
+	case "HMSET":
+		if len(args) < 4 || len(args)%2 != 0 {
+			return fakeError("ERR wrong number of arguments for 'hmset' command")
+		}
+		h, ok := db[args[1]].(map[string][]byte)
+		if !ok {
+			if _, exists := db[args[1]]; exists {
+				return wrongType
+			}
+			h = make(map[string][]byte)
+			db[args[1]] = h
+		}
+		for i := 2; i < len(args); i += 2 {
+			h[args[i]] = []byte(args[i+1])
+		}
+		return status("OK")
+
+	case "SET":
+		db[args[1]] = []byte(args[2])
+		return status("OK")
+
+	case "DEL":
+		n := 0
+		for _, k := range args[1:] {
+			if _, ok := db[k]; ok {
+				delete(db, k)
+				n++
+			}
+		}
+		return n
+	}
+
+	return fakeError("ERR unknown command '" + args[0] + "'")
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(line) == 0 || line[0] != '*' {
+		return nil, fmt.Errorf("expected array, got %q", line)
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("expected bulk string, got %q", line)
+		}
+
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case fakeError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
+
+// fakeCluster is a Redis Cluster made of fakeRedis nodes
+type fakeCluster struct {
+	nodes []*fakeRedis
+
+	mu        sync.Mutex
+	owner     [numSlots]*fakeRedis
+	migrating map[int]*fakeRedis
+}
+
+// newFakeCluster returns a cluster of n nodes with the slots divided evenly between them
+func newFakeCluster(t *testing.T, n int) *fakeCluster {
+
+	c := &fakeCluster{migrating: make(map[int]*fakeRedis)}
+
+	for i := 0; i < n; i++ {
+		f := newFakeRedis(t)
+		f.cluster = c
+		c.nodes = append(c.nodes, f)
+	}
+
+	for slot := range c.owner {
+		c.owner[slot] = c.nodes[slot*n/numSlots]
+	}
+
+	return c
+}
+
+// move gives slot to node, as at the end of a resharding
+func (c *fakeCluster) move(slot int, to *fakeRedis) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.owner[slot] = to
+	delete(c.migrating, slot)
+}
+
+// migrate starts moving slot to node
+func (c *fakeCluster) migrate(slot int, to *fakeRedis) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.migrating[slot] = to
+}
+
+// slots returns the reply to CLUSTER SLOTS
+func (c *fakeCluster) slots() []interface{} {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var reply []interface{}
+	start := 0
+	for slot := 1; slot <= numSlots; slot++ {
+		if slot == numSlots || c.owner[slot] != c.owner[start] {
+			host, port, _ := net.SplitHostPort(c.owner[start].addr())
+			p, _ := strconv.Atoi(port)
+			reply = append(reply, []interface{}{start, slot - 1, []interface{}{host, p}})
+			start = slot
+		}
+	}
+
+	return reply
+}
+
+// route returns a MOVED or ASK error if node f shouldn't handle a command
+func (c *fakeCluster) route(f *fakeRedis, state *fakeConn, cmd string, args []string, db map[string]interface{}) interface{} {
+
+	switch cmd {
+	case "GET", "SET", "DEL", "HGET", "HGETALL", "HMSET":
+	default:
+		return nil
+	}
+
+	key := args[1]
+	slot := keySlot(key)
+
+	c.mu.Lock()
+	owner := c.owner[slot]
+	target := c.migrating[slot]
+	c.mu.Unlock()
+
+	if owner != f {
+		if target == f && state.asking {
+			return nil
+		}
+		return fakeError(fmt.Sprintf("MOVED %d %s", slot, owner.addr()))
+	}
+
+	if _, ok := db[key]; !ok && target != nil {
+		return fakeError(fmt.Sprintf("ASK %d %s", slot, target.addr()))
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"github.com/garyburd/redigo/redis"
+)
+
+// GetFields returns all the fields of the hash stored at key, and a bool indicating if the key was present
+func (s *Storage) GetFields(key string) (map[string][]byte, bool, error) {
+
+	repl, err := redis.ByteSlices(s.do("HGETALL", s.opts.Prefix+key))
+	if err != nil {
+		return nil, false, wrapError(err)
+	}
+
+	// redis doesn't store empty hashes, so this is a missing key
+	if len(repl) == 0 {
+		return nil, false, nil
+	}
+
+	fields := make(map[string][]byte, len(repl)/2)
+	for i := 0; i+1 < len(repl); i += 2 {
+		fields[string(repl[i])] = repl[i+1]
+	}
+
+	return fields, true, nil
+}
+
+// SetFields replaces the hash stored at key with fields
+func (s *Storage) SetFields(key string, fields map[string][]byte) error {
+	return setResult(s.exec(s.setFieldsCall(key, fields)))
+}
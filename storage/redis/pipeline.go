@@ -0,0 +1,315 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// command is a single redis command
+type command struct {
+	name string
+	args []interface{}
+}
+
+// call is the commands for one Storage operation.  Like redigo's Do, its
+// reply is that of the last command, and its error the first error.
+type call struct {
+	key  string
+	cmds []command
+
+	reply interface{}
+	err   error
+	done  chan struct{} // closed when a coalesced call has finished
+}
+
+func newCall(key string, cmds ...command) *call {
+	return &call{key: key, cmds: cmds}
+}
+
+func (s *Storage) getCall(key string) *call {
+	key = s.opts.Prefix + key
+	if s.opts.Mode == ModeHash {
+		return newCall(key, command{"HGET", []interface{}{key, s.opts.Field}})
+	}
+	return newCall(key, command{"GET", []interface{}{key}})
+}
+
+func (s *Storage) setCall(key string, val []byte) *call {
+	if s.opts.Mode == ModeHash {
+		return s.setFieldsCall(key, map[string][]byte{s.opts.Field: val})
+	}
+	key = s.opts.Prefix + key
+	return newCall(key, command{"SET", []interface{}{key, val}})
+}
+
+func (s *Storage) setFieldsCall(key string, fields map[string][]byte) *call {
+
+	key = s.opts.Prefix + key
+
+	if len(fields) == 0 {
+		return newCall(key, command{"DEL", []interface{}{key}})
+	}
+
+	args := redis.Args{key}
+	for f, v := range fields {
+		args = args.Add(f, v)
+	}
+
+	// replace the hash atomically, so no stale fields are left behind
+	return newCall(key,
+		command{"MULTI", nil},
+		command{"DEL", []interface{}{key}},
+		command{"HMSET", args},
+		command{"EXEC", nil},
+	)
+}
+
+func (s *Storage) deleteCall(key string) *call {
+	key = s.opts.Prefix + key
+	return newCall(key, command{"DEL", []interface{}{key}})
+}
+
+func getResult(repl interface{}, err error) ([]byte, bool, error) {
+
+	if repl == nil {
+		return nil, false, wrapError(err)
+	}
+
+	val, err := redis.Bytes(repl, err)
+
+	return val, true, wrapError(err)
+}
+
+func setResult(repl interface{}, err error) error {
+
+	if err != nil {
+		return wrapError(err)
+	}
+
+	// errors from commands in a transaction are returned in the reply to EXEC
+	if results, ok := repl.([]interface{}); ok {
+		for _, r := range results {
+			if err, ok := r.(redis.Error); ok {
+				return wrapError(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func deleteResult(repl interface{}, err error) (bool, error) {
+	val, err := redis.Int(repl, err)
+	return val == 1, wrapError(err)
+}
+
+// runOn runs the call's commands on conn
+func (c *call) runOn(conn redis.Conn) (interface{}, error) {
+	last := len(c.cmds) - 1
+	for _, cmd := range c.cmds[:last] {
+		conn.Send(cmd.name, cmd.args...)
+	}
+	return conn.Do(c.cmds[last].name, c.cmds[last].args...)
+}
+
+// exec runs a call, coalescing it with other concurrent calls if pipelining is enabled
+func (s *Storage) exec(c *call) (interface{}, error) {
+
+	if s.opts.PipelineWindow == 0 {
+		return s.run(c.key, c.runOn)
+	}
+
+	c.done = make(chan struct{})
+
+	s.pmu.Lock()
+	s.pending = append(s.pending, c)
+	var full []*call
+	if len(s.pending) >= s.opts.PipelineSize {
+		full, s.pending = s.pending, nil
+	} else if len(s.pending) == 1 {
+		time.AfterFunc(s.opts.PipelineWindow, s.flush)
+	}
+	s.pmu.Unlock()
+
+	if full != nil {
+		s.pipeline(full)
+	}
+
+	<-c.done
+	return c.reply, c.err
+}
+
+// flush sends the calls waiting to be pipelined
+func (s *Storage) flush() {
+
+	s.pmu.Lock()
+	calls := s.pending
+	s.pending = nil
+	s.pmu.Unlock()
+
+	if len(calls) > 0 {
+		s.pipeline(calls)
+	}
+}
+
+// pipeline sends calls to the servers responsible for their keys, with one
+// round trip per server
+func (s *Storage) pipeline(calls []*call) {
+
+	groups := make(map[*redis.Pool][]*call)
+	for _, c := range calls {
+		p := s.keyPool(c.key)
+		groups[p] = append(groups[p], c)
+	}
+
+	var wg sync.WaitGroup
+	for p, cs := range groups {
+		wg.Add(1)
+		go func(p *redis.Pool, cs []*call) {
+			defer wg.Done()
+			conn := p.Get()
+			runPipeline(conn, cs)
+			conn.Close()
+		}(p, cs)
+	}
+	wg.Wait()
+
+	// follow cluster redirections one call at a time
+	if s.cluster != nil {
+		for _, c := range calls {
+			if _, _, _, ok := parseRedirect(c.err); ok {
+				c.reply, c.err = s.run(c.key, c.runOn)
+			}
+		}
+	}
+
+	for _, c := range calls {
+		if c.done != nil {
+			close(c.done)
+		}
+	}
+}
+
+// keyPool returns the connection pool for the server responsible for key
+func (s *Storage) keyPool(key string) *redis.Pool {
+	if s.cluster != nil {
+		return s.nodePool(s.nodeAddr(key))
+	}
+	return s.pool()
+}
+
+// runPipeline sends all the calls' commands on conn, then reads the replies
+func runPipeline(conn redis.Conn, calls []*call) {
+
+	for _, c := range calls {
+		for _, cmd := range c.cmds {
+			conn.Send(cmd.name, cmd.args...)
+		}
+	}
+
+	// an error other than a redis error reply breaks the connection, and fails the rest of the calls
+	fatal := conn.Flush()
+
+	for _, c := range calls {
+		for range c.cmds {
+			if fatal != nil {
+				c.reply, c.err = nil, fatal
+				break
+			}
+
+			reply, err := conn.Receive()
+			if _, ok := err.(redis.Error); ok {
+				if c.err == nil {
+					c.err = err
+				}
+				continue
+			}
+			if err != nil {
+				fatal = err
+				c.reply, c.err = nil, err
+				break
+			}
+
+			c.reply = reply
+		}
+	}
+}
+
+// Batch is a set of operations sent to redis together, with one round trip per server
+type Batch struct {
+	s     *Storage
+	calls []*call
+	kinds []int
+}
+
+// Result is the result of one operation in a Batch.  Found is the bool
+// returned by Get or Delete.
+type Result struct {
+	Value []byte
+	Found bool
+	Err   error
+}
+
+const (
+	batchGet = iota
+	batchSet
+	batchDelete
+)
+
+// NewBatch returns an empty batch
+func (s *Storage) NewBatch() *Batch {
+	return &Batch{s: s}
+}
+
+func (b *Batch) add(c *call, kind int) {
+	b.calls = append(b.calls, c)
+	b.kinds = append(b.kinds, kind)
+}
+
+// Get adds a Get to the batch
+func (b *Batch) Get(key string) { b.add(b.s.getCall(key), batchGet) }
+
+// Set adds a Set to the batch
+func (b *Batch) Set(key string, val []byte) { b.add(b.s.setCall(key, val), batchSet) }
+
+// Delete adds a Delete to the batch
+func (b *Batch) Delete(key string) { b.add(b.s.deleteCall(key), batchDelete) }
+
+// Len returns the number of operations in the batch
+func (b *Batch) Len() int { return len(b.calls) }
+
+// Exec sends the batch, and returns the results in the order the operations
+// were added, and the first error.  The batch is empty afterwards.
+func (b *Batch) Exec() ([]Result, error) {
+
+	calls, kinds := b.calls, b.kinds
+	b.calls, b.kinds = nil, nil
+
+	if len(calls) == 0 {
+		return nil, nil
+	}
+
+	b.s.pipeline(calls)
+
+	var firstErr error
+	results := make([]Result, len(calls))
+	for i, c := range calls {
+		r := &results[i]
+		switch kinds[i] {
+		case batchGet:
+			r.Value, r.Found, r.Err = getResult(c.reply, c.err)
+		case batchSet:
+			r.Err = setResult(c.reply, c.err)
+		case batchDelete:
+			r.Found, r.Err = deleteResult(c.reply, c.err)
+		}
+
+		if firstErr == nil {
+			firstErr = r.Err
+		}
+	}
+
+	return results, firstErr
+}
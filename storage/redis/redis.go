@@ -1,58 +1,310 @@
 // Package redis is a redis-backed key-value store
 package redis
 
-// TODO: http://godoc.org/git.tideland.biz/godm/redis has support for HASH
-
 import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
 	"github.com/garyburd/redigo/redis"
 )
 
+// Default pool settings
+const (
+	DefaultMaxIdle     = 10
+	DefaultIdleTimeout = 4 * time.Minute
+)
+
+// DefaultPipelineSize is the default maximum number of calls coalesced into one pipeline
+const DefaultPipelineSize = 100
+
+// DefaultField is the hash field holding values set with Set in hash mode
+const DefaultField = "value"
+
+// Mode is how values are stored in redis
+type Mode int
+
+const (
+	// ModeString stores each value as a redis string
+	ModeString Mode = iota
+	// ModeHash stores each value as a redis hash, like ShardedKV::Storage::Redis::Hash
+	ModeHash
+)
+
+// Options configures a Storage
+type Options struct {
+	// How values are stored.  Default ModeString.
+	Mode Mode
+	// Prefix is prepended to every key
+	Prefix string
+	// In hash mode, the field that Get and Set read and write.  Default DefaultField.
+	Field string
+
+	// The maximum number of idle connections kept in the pool.  Default DefaultMaxIdle.
+	MaxIdle int
+	// The maximum number of connections open at once.  Zero means no limit.
+	MaxActive int
+	// If Wait is true and MaxActive connections are in use, requests wait for a free connection instead of failing
+	Wait bool
+	// Idle connections are closed after this long.  Default DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	// Timeouts for connecting, and for reading and writing a single command.  Zero means no timeout.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// If Password is set, connections are authenticated with AUTH
+	Password string
+	// The database selected with SELECT
+	DB int
+
+	// If PipelineWindow is non-zero, Get, Set and Delete calls made within
+	// this long of each other are sent together in one pipeline.
+	PipelineWindow time.Duration
+	// The most calls sent in one pipeline.  Default DefaultPipelineSize.
+	PipelineSize int
+}
+
+// Storage is a redis-backed storage.  It is safe for concurrent use.
 type Storage struct {
+	opts Options
+
+	// set if the primary is found with Sentinel; see NewSentinel
+	sentinel *sentinel
+	// set if connected to a Redis Cluster; see NewCluster
+	cluster *cluster
+
+	mu   sync.Mutex
 	addr string
-	r    redis.Conn
+	p    *redis.Pool
+	// connections idle since before this are checked before they're used; see ResetConnection
+	resetAt time.Time
+
+	// calls waiting to be pipelined
+	pmu     sync.Mutex
+	pending []*call
+}
+
+// wrapError classifies an error from redigo with the shardedkv error kinds
+func wrapError(err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return shardedkv.NewError(shardedkv.ErrTimeout, err)
+	}
+
+	var rerr redis.Error
+	if errors.As(err, &rerr) {
+		// server replies that mean it can't serve requests right now
+		for _, prefix := range []string{"LOADING", "BUSY", "MASTERDOWN", "READONLY", "TRYAGAIN", "CLUSTERDOWN"} {
+			if strings.HasPrefix(string(rerr), prefix) {
+				return shardedkv.NewError(shardedkv.ErrUnavailable, err)
+			}
+		}
+		return err
+	}
+
+	if errors.As(err, &nerr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return shardedkv.NewError(shardedkv.ErrUnavailable, err)
+	}
+
+	return err
 }
 
 // New returns a new storage, backed  by the redis server at 'addr'
 func New(addr string) (*Storage, error) {
+	return NewWithOptions(addr, Options{})
+}
 
-	conn, err := redis.Dial("tcp", addr)
+// NewWithOptions returns a new storage backed by the redis server at 'addr', with a connection pool configured by opts
+func NewWithOptions(addr string, opts Options) (*Storage, error) {
 
-	if err != nil {
+	s := newStorage(opts)
+	s.addr = addr
+	s.p = s.newPool(addr)
+
+	// check we can connect
+	if err := s.Ping(); err != nil {
+		s.p.Close()
 		return nil, err
 	}
 
-	return &Storage{addr: addr, r: conn}, nil
+	return s, nil
 }
 
-func (s *Storage) Get(key string) ([]byte, bool, error) {
+func newStorage(opts Options) *Storage {
+
+	if opts.MaxIdle == 0 {
+		opts.MaxIdle = DefaultMaxIdle
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.Field == "" {
+		opts.Field = DefaultField
+	}
+	if opts.PipelineSize == 0 {
+		opts.PipelineSize = DefaultPipelineSize
+	}
+
+	return &Storage{opts: opts}
+}
+
+func (s *Storage) newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     s.opts.MaxIdle,
+		MaxActive:   s.opts.MaxActive,
+		Wait:        s.opts.Wait,
+		IdleTimeout: s.opts.IdleTimeout,
+		Dial:        func() (redis.Conn, error) { return s.dial(addr, true) },
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < time.Minute && !t.Before(s.lastReset()) {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+// dial connects to addr.  If auth is true, the connection is authenticated and selects the database.
+func (s *Storage) dial(addr string, auth bool) (redis.Conn, error) {
 
-	repl, err := s.r.Do("GET", key)
+	options := []redis.DialOption{
+		redis.DialConnectTimeout(s.opts.DialTimeout),
+		redis.DialReadTimeout(s.opts.ReadTimeout),
+		redis.DialWriteTimeout(s.opts.WriteTimeout),
+	}
 
-	if repl == nil {
-		return nil, false, err
+	if auth {
+		options = append(options, redis.DialPassword(s.opts.Password), redis.DialDatabase(s.opts.DB))
 	}
 
-	val, err := redis.Bytes(repl, err)
+	return redis.Dial("tcp", addr, options...)
+}
+
+func (s *Storage) lastReset() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.resetAt
+}
+
+// markReset makes the pools check each idle connection before it's next used
+func (s *Storage) markReset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resetAt = time.Now()
+}
+
+func (s *Storage) pool() *redis.Pool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.p
+}
+
+// run calls f with a connection to the server responsible for key.  Broken
+// connections are closed instead of being returned to the pool.
+func (s *Storage) run(key string, f func(conn redis.Conn) (interface{}, error)) (interface{}, error) {
+
+	if s.cluster != nil {
+		return s.runCluster(key, f)
+	}
+
+	conn := s.pool().Get()
+	defer conn.Close()
+	return f(conn)
+}
+
+// do runs a command whose first argument is the key
+func (s *Storage) do(cmd string, args ...interface{}) (interface{}, error) {
+
+	var key string
+	if len(args) > 0 {
+		key, _ = args[0].(string)
+	}
+
+	return s.run(key, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do(cmd, args...)
+	})
+}
 
-	return val, true, err
+func (s *Storage) Get(key string) ([]byte, bool, error) {
+	return getResult(s.exec(s.getCall(key)))
 }
 
 func (s *Storage) Set(key string, val []byte) error {
-	_, err := s.r.Do("SET", key, val)
-	return err
+	return setResult(s.exec(s.setCall(key, val)))
 }
 
 func (s *Storage) Delete(key string) (bool, error) {
-	repl, err := s.r.Do("DEL", key)
-	val, err := redis.Int(repl, err)
-	return val == 1, err
+	return deleteResult(s.exec(s.deleteCall(key)))
+}
+
+// Ping implements shardedkv.Pinger
+func (s *Storage) Ping() error {
+	_, err := s.do("PING")
+	return wrapError(err)
 }
 
+// ResetConnection drains broken connections from the pool.  A connection
+// which fails a request is already discarded, so this only makes the pool
+// check each idle connection with a PING before it's next used, and discard
+// any that fail.  Healthy connections, and requests in flight on other
+// goroutines, aren't disturbed, so it's cheap to call after every error.
+//
+// With Sentinel, the primary is discovered again, and if it has moved the
+// pool is replaced, so this is how to follow a fail-over.  With Cluster, the
+// slot map is reloaded.
 func (s *Storage) ResetConnection(key string) error {
-	s.r.Close()
 
-	var err error
-	s.r, err = redis.Dial("tcp", s.addr)
+	s.markReset()
 
-	return err
+	if s.cluster != nil {
+		return s.loadSlots()
+	}
+
+	if s.sentinel == nil {
+		return nil
+	}
+
+	addr, err := s.discover()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	old := s.p
+	if addr == s.addr {
+		old = nil
+	} else {
+		s.addr = addr
+		s.p = s.newPool(addr)
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		// connections in use are closed when their request finishes
+		old.Close()
+	}
+
+	return nil
+}
+
+// Close closes the connection pools
+func (s *Storage) Close() error {
+
+	if s.cluster != nil {
+		return s.closeCluster()
+	}
+
+	return s.pool().Close()
 }
@@ -1,8 +1,14 @@
 package redis
 
 import (
-	"github.com/dgryski/go-shardedkv/storagetest"
+	"errors"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/storagetest"
 )
 
 func TestRedis(t *testing.T) {
@@ -15,3 +21,487 @@ func TestRedis(t *testing.T) {
 
 	storagetest.StorageTest(t, s)
 }
+
+func TestFake(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := New(f.addr())
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	storagetest.StorageTest(t, s)
+}
+
+func TestPool(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := NewWithOptions(f.addr(), Options{MaxIdle: 4, MaxActive: 4, Wait: true})
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			for j := 0; j < 50; j++ {
+				if err := s.Set(key, []byte(key)); err != nil {
+					t.Errorf("Set(%s): %v", key, err)
+					return
+				}
+				if v, ok, err := s.Get(key); err != nil || !ok || string(v) != key {
+					t.Errorf("Get(%s)=(%q,%v,%v)", key, v, ok, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if accepted, _ := f.connections(); accepted > 4 {
+		t.Errorf("opened %d connections, want at most 4", accepted)
+	}
+}
+
+func TestAuthAndDB(t *testing.T) {
+
+	f := newFakeRedis(t)
+	f.password = "sekrit"
+
+	if _, err := New(f.addr()); err == nil {
+		t.Errorf("connected without a password")
+	}
+
+	if _, err := NewWithOptions(f.addr(), Options{Password: "wrong"}); err == nil {
+		t.Errorf("connected with the wrong password")
+	}
+
+	s1, err := NewWithOptions(f.addr(), Options{Password: "sekrit", DB: 1})
+	if err != nil {
+		t.Fatalf("error connecting with password: %v", err)
+	}
+	defer s1.Close()
+
+	s2, err := NewWithOptions(f.addr(), Options{Password: "sekrit", DB: 2})
+	if err != nil {
+		t.Fatalf("error connecting with password: %v", err)
+	}
+	defer s2.Close()
+
+	s1.Set("foo", []byte("one"))
+	if _, ok, _ := s2.Get("foo"); ok {
+		t.Errorf("key set in db 1 found in db 2")
+	}
+	if v, ok, err := s1.Get("foo"); err != nil || !ok || string(v) != "one" {
+		t.Errorf("Get(foo)=(%q,%v,%v), want (one,true,nil)", v, ok, err)
+	}
+}
+
+func TestResetConnection(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := New(f.addr())
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	s.Set("foo", []byte("bar"))
+
+	// simulate a server restart; the pooled connection is now broken
+	f.dropAll()
+
+	_, _, err = s.Get("foo")
+	if !errors.Is(err, shardedkv.ErrUnavailable) {
+		t.Errorf("Get on a broken connection: got %v, want ErrUnavailable", err)
+	}
+
+	if err := s.ResetConnection("foo"); err != nil {
+		t.Fatalf("ResetConnection: %v", err)
+	}
+
+	if v, ok, err := s.Get("foo"); err != nil || !ok || string(v) != "bar" {
+		t.Errorf("Get after reset=(%q,%v,%v), want (bar,true,nil)", v, ok, err)
+	}
+
+	if _, open := f.connections(); open != 1 {
+		t.Errorf("%d connections open after reset, want 1", open)
+	}
+
+	// a reset with healthy connections doesn't redial
+	accepted, _ := f.connections()
+	if err := s.ResetConnection("foo"); err != nil {
+		t.Fatalf("ResetConnection: %v", err)
+	}
+	s.Get("foo")
+	if now, _ := f.connections(); now != accepted {
+		t.Errorf("%d connections dialled after a reset with healthy connections, want 0", now-accepted)
+	}
+
+	// with several idle connections broken, the reset drains all of them
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Get("foo")
+		}()
+	}
+	wg.Wait()
+
+	f.dropAll()
+
+	if err := s.ResetConnection("foo"); err != nil {
+		t.Fatalf("ResetConnection: %v", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if v, ok, err := s.Get("foo"); err != nil || !ok || string(v) != "bar" {
+			t.Errorf("Get %d after dropping idle connections and resetting=(%q,%v,%v), want (bar,true,nil)", i, v, ok, err)
+		}
+	}
+}
+
+var _ shardedkv.Pinger = &Storage{}
+
+func TestHashMode(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := NewWithOptions(f.addr(), Options{Mode: ModeHash, Prefix: "kv:"})
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	storagetest.StorageTest(t, s)
+
+	s.Set("foo", []byte("bar"))
+
+	f.mu.Lock()
+	h, ok := f.dbs[0]["kv:foo"].(map[string][]byte)
+	f.mu.Unlock()
+	if !ok || string(h[DefaultField]) != "bar" {
+		t.Errorf("value not stored in hash field %q under prefixed key: %q", DefaultField, h)
+	}
+
+	fields := map[string][]byte{"name": []byte("gopher"), "age": []byte("10")}
+	if err := s.SetFields("user", fields); err != nil {
+		t.Fatalf("SetFields: %v", err)
+	}
+
+	got, ok, err := s.GetFields("user")
+	if err != nil || !ok || len(got) != 2 || string(got["name"]) != "gopher" || string(got["age"]) != "10" {
+		t.Errorf("GetFields(user)=(%q,%v,%v), want %q", got, ok, err, fields)
+	}
+
+	// setting replaces the whole hash
+	s.SetFields("user", map[string][]byte{"name": []byte("rob")})
+	got, _, _ = s.GetFields("user")
+	if len(got) != 1 || string(got["name"]) != "rob" {
+		t.Errorf("GetFields(user) after replace=%q, want only name=rob", got)
+	}
+
+	if _, ok, err := s.GetFields("missing"); ok || err != nil {
+		t.Errorf("GetFields(missing)=(%v,%v), want (false,nil)", ok, err)
+	}
+
+	if ok, err := s.Delete("user"); !ok || err != nil {
+		t.Errorf("Delete(user)=(%v,%v), want (true,nil)", ok, err)
+	}
+
+	// a string mode store reading a hash gets an error
+	str, _ := NewWithOptions(f.addr(), Options{Prefix: "kv:"})
+	defer str.Close()
+	if _, _, err := str.Get("foo"); err == nil {
+		t.Errorf("reading a hash in string mode succeeded")
+	}
+}
+
+func TestSentinel(t *testing.T) {
+
+	primary, replica := newFakeRedis(t), newFakeRedis(t)
+
+	sentinelNode := newFakeRedis(t)
+	sentinelNode.masters = map[string]string{"mymaster": primary.addr()}
+
+	if _, err := NewSentinel("unknown", []string{sentinelNode.addr()}, Options{}); err != ErrNoPrimary {
+		t.Errorf("NewSentinel(unknown)=%v, want ErrNoPrimary", err)
+	}
+
+	// the first sentinel is down
+	down := newFakeRedis(t)
+	down.close()
+
+	s, err := NewSentinel("mymaster", []string{down.addr(), sentinelNode.addr()}, Options{})
+	if err != nil {
+		t.Fatalf("NewSentinel: %v", err)
+	}
+	defer s.Close()
+
+	storagetest.StorageTest(t, s)
+
+	s.Set("foo", []byte("primary"))
+	if !nodeHas(primary, "foo") {
+		t.Errorf("key not written to the primary")
+	}
+
+	// fail over
+	sentinelNode.mu.Lock()
+	sentinelNode.masters["mymaster"] = replica.addr()
+	sentinelNode.mu.Unlock()
+
+	if err := s.ResetConnection("foo"); err != nil {
+		t.Fatalf("ResetConnection: %v", err)
+	}
+
+	s.Set("foo", []byte("replica"))
+
+	if v, _, _ := s.Get("foo"); !nodeHas(replica, "foo") || string(v) != "replica" {
+		t.Errorf("key not written to the new primary after fail-over")
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 0x31c3},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"{user1000}.following", keySlot("user1000")},
+		{"{user1000}.followers", keySlot("user1000")},
+		{"foo{}{bar}", keySlot("foo{}{bar}")},
+		{"foo{{bar}}", keySlot("{bar")},
+	}
+
+	for _, tt := range tests {
+		if got := keySlot(tt.key); got != tt.slot {
+			t.Errorf("keySlot(%q)=%d, want %d", tt.key, got, tt.slot)
+		}
+	}
+}
+
+// nodeHas reports if a fake redis node holds key
+func nodeHas(f *fakeRedis, key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.dbs[0][key]
+	return ok
+}
+
+func TestCluster(t *testing.T) {
+
+	c := newFakeCluster(t, 3)
+
+	s, err := NewCluster([]string{c.nodes[1].addr()}, Options{})
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	defer s.Close()
+
+	storagetest.StorageTest(t, s)
+
+	// keys go to the node owning their slot
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		s.Set(key, []byte(key))
+		owner := c.nodes[keySlot(key)*3/numSlots]
+		if !nodeHas(owner, key) {
+			t.Errorf("%s not stored on the node owning slot %d", key, keySlot(key))
+		}
+	}
+
+	// MOVED updates the slot map
+	slot := keySlot("moved")
+	moved := c.nodes[(slot*3/numSlots+1)%3]
+	c.move(slot, moved)
+
+	if err := s.Set("moved", []byte("bar")); err != nil {
+		t.Fatalf("Set after MOVED: %v", err)
+	}
+	if !nodeHas(moved, "moved") {
+		t.Errorf("key not stored on the node the slot moved to")
+	}
+	if addr := s.cluster.slots[slot]; addr != moved.addr() {
+		t.Errorf("slot map not updated after MOVED: %s", addr)
+	}
+
+	// ASK is followed just for the one request
+	slot = keySlot("asked")
+	owner := c.nodes[slot*3/numSlots]
+	target := c.nodes[(slot*3/numSlots+1)%3]
+	c.migrate(slot, target)
+
+	if err := s.Set("asked", []byte("bar")); err != nil {
+		t.Fatalf("Set after ASK: %v", err)
+	}
+	if !nodeHas(target, "asked") || nodeHas(owner, "asked") {
+		t.Errorf("key not stored on the node the slot is migrating to")
+	}
+	if v, ok, err := s.Get("asked"); err != nil || !ok || string(v) != "bar" {
+		t.Errorf("Get after ASK=(%q,%v,%v), want (bar,true,nil)", v, ok, err)
+	}
+	if addr := s.cluster.slots[slot]; addr != owner.addr() {
+		t.Errorf("slot map updated after ASK: %s", addr)
+	}
+
+	// ResetConnection reloads the slot map
+	c.move(slot, target)
+	if err := s.ResetConnection("asked"); err != nil {
+		t.Fatalf("ResetConnection: %v", err)
+	}
+	if addr := s.cluster.slots[slot]; addr != target.addr() {
+		t.Errorf("slot map not reloaded: %s", addr)
+	}
+}
+
+func TestPipelineWindow(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := NewWithOptions(f.addr(), Options{PipelineWindow: 20 * time.Millisecond, PipelineSize: 1000})
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	storagetest.StorageTest(t, s)
+
+	before := f.roundTrips()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := "key" + strconv.Itoa(i)
+			if err := s.Set(key, []byte(key)); err != nil {
+				t.Errorf("Set(%s): %v", key, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := f.roundTrips() - before; n >= 10 {
+		t.Errorf("50 concurrent Sets took %d round trips, want them coalesced", n)
+	}
+
+	for i := 0; i < 50; i++ {
+		key := "key" + strconv.Itoa(i)
+		if v, ok, err := s.Get(key); err != nil || !ok || string(v) != key {
+			t.Errorf("Get(%s)=(%q,%v,%v)", key, v, ok, err)
+		}
+	}
+
+	// a full pipeline is sent without waiting for the window
+	s.opts.PipelineSize = 1
+	s.opts.PipelineWindow = time.Hour
+	if err := s.Set("foo", []byte("bar")); err != nil {
+		t.Errorf("Set with a full pipeline: %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+
+	f := newFakeRedis(t)
+
+	s, err := New(f.addr())
+	if err != nil {
+		t.Fatalf("error connecting to fake redis: %v", err)
+	}
+	defer s.Close()
+
+	s.Set("deleteme", []byte("x"))
+
+	before := f.roundTrips()
+
+	b := s.NewBatch()
+	for i := 0; i < 100; i++ {
+		key := "key" + strconv.Itoa(i)
+		b.Set(key, []byte(key))
+	}
+	b.Get("key1")
+	b.Get("missing")
+	b.Delete("deleteme")
+	b.Delete("missing")
+
+	results, err := b.Exec()
+	if err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	if n := f.roundTrips() - before; n != 1 {
+		t.Errorf("batch took %d round trips, want 1", n)
+	}
+
+	if b.Len() != 0 {
+		t.Errorf("batch not empty after Exec")
+	}
+
+	r := results[100:]
+	if string(r[0].Value) != "key1" || !r[0].Found || r[1].Found || !r[2].Found || r[3].Found {
+		t.Errorf("unexpected batch results: %+v", r)
+	}
+
+	// errors are returned for the individual operations
+	hash, _ := NewWithOptions(f.addr(), Options{Mode: ModeHash})
+	defer hash.Close()
+
+	b = hash.NewBatch()
+	b.Set("h", []byte("field value"))
+	b.Get("key1")
+	b.Get("h")
+
+	results, err = b.Exec()
+	if err == nil || results[0].Err != nil || results[1].Err == nil || string(results[2].Value) != "field value" {
+		t.Errorf("hash mode batch: err=%v results=%+v", err, results)
+	}
+}
+
+func TestClusterBatch(t *testing.T) {
+
+	c := newFakeCluster(t, 3)
+
+	s, err := NewCluster([]string{c.nodes[0].addr()}, Options{})
+	if err != nil {
+		t.Fatalf("NewCluster: %v", err)
+	}
+	defer s.Close()
+
+	slot := keySlot("moved")
+	moved := c.nodes[(slot*3/numSlots+1)%3]
+	c.move(slot, moved)
+
+	b := s.NewBatch()
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		b.Set(key, []byte(key))
+	}
+	b.Set("moved", []byte("bar"))
+
+	if _, err := b.Exec(); err != nil {
+		t.Fatalf("Exec: %v", err)
+	}
+
+	for i := 0; i < 30; i++ {
+		key := "key" + strconv.Itoa(i)
+		if !nodeHas(c.nodes[keySlot(key)*3/numSlots], key) {
+			t.Errorf("%s not stored on the node owning its slot", key)
+		}
+	}
+
+	if !nodeHas(moved, "moved") {
+		t.Errorf("redirected key not stored on the node the slot moved to")
+	}
+}
@@ -0,0 +1,73 @@
+package redis
+
+import (
+	"errors"
+	"net"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoPrimary is returned when none of the sentinels know the address of the primary
+var ErrNoPrimary = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("redis: no sentinel knows the primary"))
+
+type sentinel struct {
+	master    string
+	sentinels []string
+}
+
+// NewSentinel returns a new storage backed by the primary of the redis
+// servers named 'master', which is found by asking each of the sentinels in
+// turn.  After a fail-over, call ResetConnection to find the new primary.
+func NewSentinel(master string, sentinels []string, opts Options) (*Storage, error) {
+
+	s := newStorage(opts)
+	s.sentinel = &sentinel{master: master, sentinels: sentinels}
+
+	addr, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	s.addr = addr
+	s.p = s.newPool(addr)
+
+	if err := s.Ping(); err != nil {
+		s.p.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// discover asks the sentinels for the address of the primary
+func (s *Storage) discover() (string, error) {
+
+	err := ErrNoPrimary
+
+	for _, addr := range s.sentinel.sentinels {
+
+		conn, derr := s.dial(addr, false)
+		if derr != nil {
+			err = wrapError(derr)
+			continue
+		}
+
+		repl, rerr := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.sentinel.master))
+		conn.Close()
+
+		if rerr == redis.ErrNil {
+			continue
+		}
+		if rerr != nil {
+			err = wrapError(rerr)
+			continue
+		}
+
+		if len(repl) == 2 {
+			return net.JoinHostPort(repl[0], repl[1]), nil
+		}
+	}
+
+	return "", err
+}
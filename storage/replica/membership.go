@@ -0,0 +1,154 @@
+package replica
+
+import (
+	"sync"
+
+	shardedkv "github.com/dgryski/go-shardedkv"
+)
+
+// AddReplica adds a new replica.  The replica immediately begins receiving
+// writes, but doesn't serve reads until the values for keys have been copied
+// to it from the existing replicas.  The backfill starts once the writes
+// already in flight, which don't include the new replica, have finished.  If
+// the backfill fails, the replica is removed again and the error is returned.
+func (s *Storage) AddReplica(replica shardedkv.Storage, keys []string) error {
+
+	b := &bootstrap{Storage: replica, touched: make(map[string]struct{})}
+
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID++
+	s.members = append(s.members[:len(s.members):len(s.members)], member{id: id, storage: b, bootstrapping: true})
+	s.mu.Unlock()
+
+	// wait for writes using an older snapshot, so backfill sees their values
+	s.writes.Lock()
+	s.writes.Unlock()
+
+	if err := s.backfill(b, keys); err != nil {
+		s.remove(func(m member) bool { return m.id == id })
+		return err
+	}
+
+	s.mu.Lock()
+	members := make([]member, len(s.members))
+	copy(members, s.members)
+	for i := range members {
+		if members[i].id == id {
+			members[i] = member{id: id, storage: replica}
+		}
+	}
+	s.members = members
+	s.mu.Unlock()
+
+	return nil
+}
+
+// RemoveReplica removes a replica.  Replicas are compared with ==.  Requests
+// already in flight may still use it.
+func (s *Storage) RemoveReplica(replica shardedkv.Storage) error {
+	if !s.remove(func(m member) bool { return m.replica() == replica }) {
+		return ErrUnknownReplica
+	}
+	return nil
+}
+
+// ReplaceReplica adds replacement, backfilling keys as in AddReplica, and then removes old.
+func (s *Storage) ReplaceReplica(old, replacement shardedkv.Storage, keys []string) error {
+
+	found := false
+	for _, m := range s.snapshot() {
+		if m.replica() == old {
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		return ErrUnknownReplica
+	}
+
+	if err := s.AddReplica(replacement, keys); err != nil {
+		return err
+	}
+
+	return s.RemoveReplica(old)
+}
+
+// remove deletes the first member matching f and reports if one was found
+func (s *Storage) remove(f func(m member) bool) bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, m := range s.members {
+		if f(m) {
+			members := make([]member, 0, len(s.members)-1)
+			members = append(members, s.members[:i]...)
+			members = append(members, s.members[i+1:]...)
+			s.members = members
+			return true
+		}
+	}
+
+	return false
+}
+
+// backfill copies keys from the readable replicas into b
+func (s *Storage) backfill(b *bootstrap, keys []string) error {
+
+	for _, key := range keys {
+
+		b.mu.Lock()
+
+		if _, ok := b.touched[key]; ok {
+			// a client wrote this key since we started, so it's already up to date
+			b.mu.Unlock()
+			continue
+		}
+
+		val, ok, err := s.get(key, readable(s.snapshot(), nil))
+		if err == nil && ok {
+			err = b.Storage.Set(key, val)
+		}
+
+		b.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// replica returns the underlying storage for m
+func (m member) replica() shardedkv.Storage {
+	if b, ok := m.storage.(*bootstrap); ok {
+		return b.Storage
+	}
+	return m.storage
+}
+
+// bootstrap wraps a replica while it is being backfilled, and tracks which
+// keys are written so the backfill doesn't overwrite them with older values.
+type bootstrap struct {
+	shardedkv.Storage
+
+	mu      sync.Mutex
+	touched map[string]struct{}
+}
+
+func (b *bootstrap) Set(key string, val []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.touched[key] = struct{}{}
+	return b.Storage.Set(key, val)
+}
+
+func (b *bootstrap) Delete(key string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.touched[key] = struct{}{}
+	return b.Storage.Delete(key)
+}
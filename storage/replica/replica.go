@@ -2,9 +2,11 @@
 package replica
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 
 	shardedkv "github.com/dgryski/go-shardedkv"
@@ -12,10 +14,45 @@ import (
 
 type Storage struct {
 	MaxFailures int
-	Replicas    []shardedkv.Storage
-	hedgedTime  time.Duration
+	// DeleteQuorum, if non-zero, is the number of replicas which must
+	// confirm a Delete before it returns.  The remaining replicas are
+	// still sent the delete, but we don't wait for them to finish, so the
+	// bool Delete returns only reflects the replicas which answered first: it
+	// may be false even though a slower replica held the key and deleted it.
+	// If there are fewer replicas than DeleteQuorum, Delete returns ErrNoQuorum.
+	DeleteQuorum int
+	hedgedTime   time.Duration
+
+	// members is copy-on-write: requests take a snapshot and never see it change underneath them
+	mu      sync.Mutex
+	members []member
+	nextID  int
+
+	// writes hold this for reading until every replica has answered, so
+	// AddReplica can wait for those which took a snapshot without the new replica
+	writes sync.RWMutex
 }
 
+// member is a replica along with a stable id used in errors and sessions
+type member struct {
+	id      int
+	storage shardedkv.Storage
+	// bootstrapping replicas receive writes but don't serve reads
+	bootstrapping bool
+}
+
+// ErrUnknownReplica is returned when removing or replacing a replica that isn't a member of the Storage
+var ErrUnknownReplica = errors.New("replica: unknown replica")
+
+// ErrNoReplicas is returned when there are no replicas available to serve a read
+var ErrNoReplicas = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("replica: no replicas available"))
+
+// ErrNoQuorum is returned by Delete when there are fewer replicas than DeleteQuorum
+var ErrNoQuorum = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("replica: fewer replicas than the delete quorum"))
+
+// ReplicaError is an error from a single replica.  Replica is the id of the
+// replica, which is its position in the list passed to New, or the order in
+// which it was added via AddReplica.
 type ReplicaError struct {
 	Replica int
 	Err     error
@@ -25,6 +62,9 @@ func (r ReplicaError) Error() string {
 	return fmt.Sprintf("replica %d: %s", r.Replica, r.Err)
 }
 
+// Unwrap returns the error from the replica
+func (r ReplicaError) Unwrap() error { return r.Err }
+
 type MultiError []ReplicaError
 
 func (merr MultiError) Error() string {
@@ -37,30 +77,119 @@ func (merr MultiError) Error() string {
 	return strings.Join(errs, ";")
 }
 
+// Is reports whether any of the replica errors match target
+func (merr MultiError) Is(target error) bool {
+	for _, e := range merr {
+		if errors.Is(e.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
 // New returns a Storage that queries multiple replicas in parallel
 func New(maxFailures int, replicas ...shardedkv.Storage) *Storage {
-	return &Storage{
+	s := &Storage{
 		MaxFailures: maxFailures,
-		Replicas:    replicas,
 		hedgedTime:  1 * time.Second,
 	}
+
+	for _, r := range replicas {
+		s.members = append(s.members, member{id: s.nextID, storage: r})
+		s.nextID++
+	}
+
+	return s
+}
+
+// snapshot returns the current list of replicas
+func (s *Storage) snapshot() []member {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.members
+}
+
+// readable returns the members of m which can serve reads.  If ids is
+// non-empty, only those replicas are returned, unless none of them are still
+// available.
+func readable(m []member, ids []int) []member {
+
+	var r []member
+	for _, mem := range m {
+		if !mem.bootstrapping {
+			r = append(r, mem)
+		}
+	}
+
+	if len(ids) == 0 {
+		return r
+	}
+
+	var f []member
+	for _, mem := range r {
+		for _, id := range ids {
+			if mem.id == id {
+				f = append(f, mem)
+				break
+			}
+		}
+	}
+
+	if len(f) == 0 {
+		// all the replicas that acked the write have been removed
+		return r
+	}
+
+	return f
+}
+
+// Replicas returns the current list of replicas, including any that are still bootstrapping
+func (s *Storage) Replicas() []shardedkv.Storage {
+	m := s.snapshot()
+	r := make([]shardedkv.Storage, len(m))
+	for i := range m {
+		r[i] = m[i].replica()
+	}
+	return r
+}
+
+// Session is returned by SetSession and records which replicas acknowledged
+// the write.  Passing it to GetSession routes the read to one of those
+// replicas, so a client always sees its own latest write.  The zero Session
+// places no restrictions on which replica is read.
+type Session struct {
+	replicas []int
 }
 
 func (s *Storage) Get(key string) ([]byte, bool, error) {
+	return s.get(key, readable(s.snapshot(), nil))
+}
+
+// GetSession is like Get, but only reads from replicas which acknowledged the write that returned session.
+func (s *Storage) GetSession(key string, session Session) ([]byte, bool, error) {
+	return s.get(key, readable(s.snapshot(), session.replicas))
+}
 
-	l := len(s.Replicas)
+// get queries the replicas listed in candidates
+func (s *Storage) get(key string, candidates []member) ([]byte, bool, error) {
 
-	if l == 1 {
-		return s.Replicas[0].Get(key)
+	l := len(candidates)
+
+	switch l {
+	case 0:
+		return nil, false, ErrNoReplicas
+	case 1:
+		return candidates[0].storage.Get(key)
 	}
 
-	idx1 := rand.Intn(l)
-	idx2 := rand.Intn(l - 1)
-	if idx2 >= idx1 {
-		idx2++
+	i1 := rand.Intn(l)
+	i2 := rand.Intn(l - 1)
+	if i2 >= i1 {
+		i2++
 	}
-	r1 := s.Replicas[idx1]
-	r2 := s.Replicas[idx2]
+	idx1, idx2 := candidates[i1].id, candidates[i2].id
+	r1 := candidates[i1].storage
+	r2 := candidates[i2].storage
 
 	type result struct {
 		idx int
@@ -150,48 +279,106 @@ func (s *Storage) Get(key string) ([]byte, bool, error) {
 }
 
 func (s *Storage) Set(key string, val []byte) error {
+	_, err := s.SetSession(key, val)
+	return err
+}
+
+// SetSession is like Set, but also returns a Session recording which replicas acknowledged the write.
+func (s *Storage) SetSession(key string, val []byte) (Session, error) {
 
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+
+	replicas := s.snapshot()
 	errch := make(chan *ReplicaError)
 
-	for i := 0; i < len(s.Replicas); i++ {
-		go func(replica int, errch chan *ReplicaError) {
-			err := s.Replicas[replica].Set(key, val)
-			var reperr *ReplicaError
-			if err != nil {
-				reperr = &ReplicaError{Replica: replica, Err: err}
-			}
+	for _, m := range replicas {
+		go func(m member, errch chan *ReplicaError) {
+			err := m.storage.Set(key, val)
+			reperr := &ReplicaError{Replica: m.id, Err: err}
 			errch <- reperr
-		}(i, errch)
+		}(m, errch)
 	}
 
+	var session Session
 	var merr MultiError
-	for i := 0; i < len(s.Replicas); i++ {
+	for i := 0; i < len(replicas); i++ {
 		reperr := <-errch
-		if reperr != nil {
+		if reperr.Err != nil {
 			merr = append(merr, *reperr)
+		} else {
+			session.replicas = append(session.replicas, reperr.Replica)
 		}
 	}
 
 	if len(merr) > s.MaxFailures {
-		return merr
+		return session, merr
 	}
 
-	return nil
+	return session, nil
 }
 
 func (s *Storage) Delete(key string) (bool, error) {
+
+	type result struct {
+		ok  bool
+		err *ReplicaError
+	}
+
+	s.writes.RLock()
+	replicas := s.snapshot()
+
+	// buffered so stragglers don't block once we've returned early on quorum
+	resch := make(chan result, len(replicas))
+
+	// the stragglers still count as a write in flight after we've returned
+	var wg sync.WaitGroup
+	wg.Add(len(replicas))
+	go func() {
+		wg.Wait()
+		s.writes.RUnlock()
+	}()
+
+	for _, m := range replicas {
+		go func(m member) {
+			defer wg.Done()
+			var r result
+			o, err := m.storage.Delete(key)
+			r.ok = o
+			if err != nil {
+				r.err = &ReplicaError{Replica: m.id, Err: err}
+			}
+			resch <- r
+		}(m)
+	}
+
 	var merr MultiError
 	var ok bool
-	for i := 0; i < len(s.Replicas); i++ {
-		o, err := s.Replicas[i].Delete(key)
+	var acks int
+	for i := 0; i < len(replicas); i++ {
+		r := <-resch
 
-		ok = ok || o
+		ok = ok || r.ok
 
-		if err != nil {
-			merr = append(merr, ReplicaError{Replica: i, Err: err})
+		if r.err != nil {
+			merr = append(merr, *r.err)
+			continue
+		}
+
+		acks++
+		if s.DeleteQuorum > 0 && acks >= s.DeleteQuorum {
+			return ok, nil
 		}
 	}
 
+	// if we were asked for a quorum and didn't get one, always report it
+	if s.DeleteQuorum > 0 && len(merr) > 0 {
+		return ok, merr
+	}
+	if s.DeleteQuorum > 0 && acks < s.DeleteQuorum {
+		return ok, ErrNoQuorum
+	}
+
 	if len(merr) > s.MaxFailures {
 		return ok, merr
 	}
@@ -200,11 +387,26 @@ func (s *Storage) Delete(key string) (bool, error) {
 }
 
 func (s *Storage) ResetConnection(key string) error {
+
+	replicas := s.snapshot()
+	errch := make(chan *ReplicaError)
+
+	for _, m := range replicas {
+		go func(m member, errch chan *ReplicaError) {
+			err := m.storage.ResetConnection(key)
+			var reperr *ReplicaError
+			if err != nil {
+				reperr = &ReplicaError{Replica: m.id, Err: err}
+			}
+			errch <- reperr
+		}(m, errch)
+	}
+
 	var merr MultiError
-	for i := 0; i < len(s.Replicas); i++ {
-		err := s.Replicas[i].ResetConnection(key)
-		if err != nil {
-			merr = append(merr, ReplicaError{Replica: i, Err: err})
+	for i := 0; i < len(replicas); i++ {
+		reperr := <-errch
+		if reperr != nil {
+			merr = append(merr, *reperr)
 		}
 	}
 
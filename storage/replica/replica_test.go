@@ -1,7 +1,11 @@
 package replica
 
 import (
+	"errors"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/dgryski/go-shardedkv/storage/memory"
 	"github.com/dgryski/go-shardedkv/storagetest"
@@ -72,3 +76,240 @@ func TestErrorReplica(t *testing.T) {
 		storagetest.StorageTest(t, r)
 	}
 }
+
+// a storage engine that blocks deletes until released
+type blockingDelete struct {
+	discard
+	release chan struct{}
+}
+
+func (b blockingDelete) Delete(key string) (bool, error) {
+	<-b.release
+	return false, nil
+}
+
+func TestDeleteQuorum(t *testing.T) {
+
+	slow := blockingDelete{release: make(chan struct{})}
+	defer close(slow.release)
+
+	m1, m2 := memory.New(), memory.New()
+	m1.Set("hello", []byte("world"))
+	m2.Set("hello", []byte("world"))
+
+	r := New(0, m1, slow, m2)
+	r.DeleteQuorum = 2
+
+	done := make(chan struct{})
+	go func() {
+		ok, err := r.Delete("hello")
+		if !ok || err != nil {
+			t.Errorf("quorum delete failed: ok=%v err=%v", ok, err)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("quorum delete waited for the slow replica")
+	}
+
+	r = New(0, storagetest.Errstore{}, storagetest.Errstore{}, memory.New())
+	r.DeleteQuorum = 2
+	if _, err := r.Delete("hello"); err == nil {
+		t.Errorf("delete without quorum didn't return an error")
+	}
+
+	// a quorum larger than the number of replicas can never be met
+	r = New(0, memory.New(), memory.New())
+	r.DeleteQuorum = 3
+	if _, err := r.Delete("hello"); err != ErrNoQuorum {
+		t.Errorf("delete with a quorum larger than the replicas: got %v, want ErrNoQuorum", err)
+	}
+}
+
+// a storage engine that serves reads but fails all writes
+type readOnly struct {
+	*memory.Storage
+}
+
+func (r readOnly) Set(key string, val []byte) error { return errors.New("read-only replica") }
+
+func TestSession(t *testing.T) {
+
+	stale := readOnly{memory.New()}
+	stale.Storage.Set("hello", []byte("stale"))
+
+	r := New(1, stale, memory.New())
+
+	session, err := r.SetSession("hello", []byte("world"))
+	if err != nil {
+		t.Fatalf("error from set with one failed replica: %v", err)
+	}
+
+	for i := 0; i < 20; i++ {
+		v, ok, err := r.GetSession("hello", session)
+		if !ok || err != nil || string(v) != "world" {
+			t.Errorf("session read didn't see latest write: v=%q ok=%v err=%v", v, ok, err)
+		}
+	}
+}
+
+func TestMembership(t *testing.T) {
+
+	m1 := memory.New()
+	r := New(0, m1)
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		k := "key" + strconv.Itoa(i)
+		keys = append(keys, k)
+		r.Set(k, []byte(k))
+	}
+
+	m2 := memory.New()
+	if err := r.AddReplica(m2, keys); err != nil {
+		t.Fatalf("error adding replica: %v", err)
+	}
+
+	for _, k := range keys {
+		v, ok, err := m2.Get(k)
+		if !ok || err != nil || string(v) != k {
+			t.Errorf("key %q not backfilled: v=%q ok=%v err=%v", k, v, ok, err)
+		}
+	}
+
+	if err := r.RemoveReplica(m1); err != nil {
+		t.Errorf("error removing replica: %v", err)
+	}
+
+	if err := r.RemoveReplica(m1); err != ErrUnknownReplica {
+		t.Errorf("removing an unknown replica: got %v, want ErrUnknownReplica", err)
+	}
+
+	m3 := memory.New()
+	if err := r.ReplaceReplica(m2, m3, keys); err != nil {
+		t.Errorf("error replacing replica: %v", err)
+	}
+
+	if rs := r.Replicas(); len(rs) != 1 || rs[0] != m3 {
+		t.Errorf("unexpected replicas after replace: %v", rs)
+	}
+
+	for _, k := range keys {
+		v, ok, err := r.Get(k)
+		if !ok || err != nil || string(v) != k {
+			t.Errorf("failed getting %q after replace: v=%q ok=%v err=%v", k, v, ok, err)
+		}
+	}
+
+	storagetest.StorageTest(t, r)
+}
+
+func TestMembershipConcurrent(t *testing.T) {
+
+	r := New(0, memory.New(), memory.New())
+
+	var keys []string
+	for i := 0; i < 100; i++ {
+		keys = append(keys, "key"+strconv.Itoa(i))
+	}
+
+	done := make(chan struct{})
+	var wg, started sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		started.Add(1)
+		go func() {
+			defer wg.Done()
+			started.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for _, k := range keys {
+					r.Set(k, []byte(k))
+					r.Get(k)
+				}
+			}
+		}()
+	}
+
+	// the writers are running, and each finishes its pass, while the replicas are replaced
+	started.Wait()
+
+	for i := 0; i < 10; i++ {
+		replicas := r.Replicas()
+		if err := r.ReplaceReplica(replicas[0], memory.New(), keys); err != nil {
+			t.Errorf("error replacing replica: %v", err)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	for _, rep := range r.Replicas() {
+		for _, k := range keys {
+			v, ok, err := rep.Get(k)
+			if !ok || err != nil || string(v) != k {
+				t.Errorf("replica missing %q: v=%q ok=%v err=%v", k, v, ok, err)
+			}
+		}
+	}
+}
+
+// a memory storage whose next Set waits until released
+type gatedSet struct {
+	*memory.Storage
+	entered chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (g *gatedSet) Set(key string, val []byte) error {
+	g.once.Do(func() {
+		close(g.entered)
+		<-g.release
+	})
+	return g.Storage.Set(key, val)
+}
+
+func TestMembershipWriteInFlight(t *testing.T) {
+
+	old := &gatedSet{Storage: memory.New(), entered: make(chan struct{}), release: make(chan struct{})}
+	r := New(0, old)
+
+	// a write is in flight on a snapshot without the new replica
+	wrote := make(chan error)
+	go func() { wrote <- r.Set("k", []byte("v")) }()
+	<-old.entered
+
+	b := memory.New()
+	added := make(chan error)
+	go func() { added <- r.AddReplica(b, []string{"k"}) }()
+
+	select {
+	case err := <-added:
+		t.Fatalf("AddReplica finished with a write in flight: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(old.release)
+	if err := <-wrote; err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if err := <-added; err != nil {
+		t.Fatalf("AddReplica: %v", err)
+	}
+
+	if err := r.RemoveReplica(old); err != nil {
+		t.Fatalf("RemoveReplica: %v", err)
+	}
+
+	if v, ok, err := r.Get("k"); !ok || err != nil || string(v) != "v" {
+		t.Errorf("Get after replacing the replica=(%q,%v,%v), want v", v, ok, err)
+	}
+}
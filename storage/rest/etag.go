@@ -0,0 +1,107 @@
+package rest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// GetETag is like Get, but also returns the value's ETag for use with SetIf and DeleteIf
+func (s *Storage) GetETag(key string) ([]byte, string, bool, error) {
+	return s.get(key)
+}
+
+// SetIf sets the value for key only if its current ETag is etag, or if etag
+// is empty, only if the key isn't present.  It returns the new ETag.  If the
+// value has changed, the error is classified as shardedkv.ErrConflict.
+func (s *Storage) SetIf(key string, val []byte, etag string) (string, error) {
+	return s.set(key, val, condition(etag))
+}
+
+// DeleteIf deletes key only if its current ETag is etag.  If the value has
+// changed, the error is classified as shardedkv.ErrConflict.
+func (s *Storage) DeleteIf(key string, etag string) (bool, error) {
+	return s.del(key, condition(etag))
+}
+
+// condition returns the headers for a request conditional on the current ETag being etag
+func condition(etag string) http.Header {
+	if etag == "" {
+		return http.Header{"If-None-Match": {"*"}}
+	}
+	return http.Header{"If-Match": {etag}}
+}
+
+// etagFor returns the ETag for a value
+func etagFor(val []byte) string {
+	sum := sha256.Sum256(val)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// matchETag reports whether an If-Match or If-None-Match header matches etag
+func matchETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// conditional reports whether a request has preconditions
+func conditional(r *http.Request) bool {
+	return r.Header.Get("If-Match") != "" || r.Header.Get("If-None-Match") != ""
+}
+
+// preconditionsMet checks a request's If-Match and If-None-Match headers against the current value
+func preconditionsMet(r *http.Request, val []byte, exists bool) bool {
+
+	if h := r.Header.Get("If-Match"); h != "" {
+		if !exists || !matchETag(h, etagFor(val)) {
+			return false
+		}
+	}
+
+	if h := r.Header.Get("If-None-Match"); h != "" {
+		if exists && matchETag(h, etagFor(val)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// lockKey locks key against other writes through the handler, so conditional writes are atomic
+func (h *Handler) lockKey(key string) func() {
+	f := fnv.New32a()
+	f.Write([]byte(key))
+	mu := &h.locks[f.Sum32()%uint32(len(h.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// checkPreconditions fetches the current value and checks the request's
+// preconditions.  If they fail, or the value can't be fetched, it writes the
+// response and returns false.
+func (h *Handler) checkPreconditions(w http.ResponseWriter, r *http.Request, key string) bool {
+
+	if !conditional(r) {
+		return true
+	}
+
+	val, ok, err := h.Store.Get(key)
+	if err != nil {
+		writeError(w, err)
+		return false
+	}
+
+	if !preconditionsMet(r, val, ok) {
+		http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,350 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+// DefaultMaxValueSize is the default largest value a Handler accepts
+const DefaultMaxValueSize = 16 << 20
+
+// The paths of the batch and health endpoints.  Keys escaped by any of the
+// escapers other than NoEscape never contain a slash, so these can't clash
+// with a key.  Handler doesn't support NoEscape keys containing slashes.
+const (
+	BatchPath  = "/_/batch"
+	HealthPath = "/_/health"
+)
+
+// An Unescaper decodes a key from a URL path segment, reversing an Escaper
+type Unescaper func(s string) (string, error)
+
+// PathUnescape reverses PathEscape
+func PathUnescape(s string) (string, error) { return url.PathUnescape(s) }
+
+// NoUnescape reverses NoEscape
+func NoUnescape(s string) (string, error) { return s, nil }
+
+// Base64Unescape reverses Base64Escape
+func Base64Unescape(s string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// HexUnescape reverses HexEscape
+func HexUnescape(s string) (string, error) {
+	b, err := hex.DecodeString(s)
+	return string(b), err
+}
+
+// Handler serves a storage over HTTP in the form Storage expects:
+//
+//	GET /key     200 with the value, or 404 if it isn't present
+//	PUT /key     204 once the value is stored
+//	DELETE /key  204 if the key was present, or 404
+//
+// The empty key is rejected with 400, as its path is the same as the root.
+//
+// Values are returned with an ETag, and PUT and DELETE honour If-Match and
+// If-None-Match, returning 412 if the value has changed.  Conditional
+// requests are only atomic with respect to other writes through the same
+// Handler.
+//
+// POST BatchPath runs a list of operations, and GET HealthPath reports
+// whether the storage is reachable, using its Ping method if it has one.
+// Errors from the storage are returned with the status Storage maps back to
+// the same kind of error, except that ErrNotFound from Get or Delete comes
+// back as a missing key.  Unclassified errors come back as ErrUnavailable.
+type Handler struct {
+	// The storage to serve
+	Store shardedkv.Storage
+	// Unescape decodes keys from the URL.  Default PathUnescape.
+	Unescape Unescaper
+	// The largest value accepted.  Default DefaultMaxValueSize.
+	MaxValueSize int64
+	// The content type of values returned by GET.  Default DefaultContentType.
+	ContentType string
+
+	// writes to a key are serialized, so conditional requests are atomic
+	locks [64]sync.Mutex
+}
+
+// BatchOp is an operation in a batch request.  Op is "get", "set" or "delete".
+type BatchOp struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value []byte `json:"value,omitempty"`
+}
+
+// BatchResult is the result of a BatchOp.  Found is the bool returned by Get or Delete.
+type BatchResult struct {
+	Value []byte `json:"value,omitempty"`
+	Found bool   `json:"found,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// errorStatus returns the HTTP status for an error from the storage
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, shardedkv.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, shardedkv.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, shardedkv.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, shardedkv.ErrRejected):
+		return http.StatusTooManyRequests
+	case errors.Is(err, shardedkv.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, shardedkv.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, ErrClient):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, err error) {
+
+	code := errorStatus(err)
+
+	var ra interface{ RetryAfter() time.Duration }
+	if (code == http.StatusServiceUnavailable || code == http.StatusTooManyRequests) && errors.As(err, &ra) && ra.RetryAfter() > 0 {
+		// round up, so the client doesn't come back too soon
+		w.Header().Set("Retry-After", strconv.Itoa(int((ra.RetryAfter()+time.Second-1)/time.Second)))
+	}
+
+	http.Error(w, err.Error(), code)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	path := r.URL.EscapedPath()
+
+	switch {
+	case path == HealthPath:
+		h.serveHealth(w, r)
+		return
+	case path == BatchPath:
+		h.serveBatch(w, r)
+		return
+	case path == "/":
+		http.Error(w, ErrEmptyKey.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !strings.HasPrefix(path, "/") || strings.Contains(path[1:], "/") {
+		http.Error(w, "bad key", http.StatusBadRequest)
+		return
+	}
+
+	unescape := h.Unescape
+	if unescape == nil {
+		unescape = PathUnescape
+	}
+
+	key, err := unescape(path[1:])
+	if err != nil {
+		http.Error(w, "bad key: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		h.serveGet(w, r, key)
+	case "PUT":
+		h.servePut(w, r, key)
+	case "DELETE":
+		h.serveDelete(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) contentType() string {
+	if h.ContentType == "" {
+		return DefaultContentType
+	}
+	return h.ContentType
+}
+
+func (h *Handler) maxValueSize() int64 {
+	if h.MaxValueSize == 0 {
+		return DefaultMaxValueSize
+	}
+	return h.MaxValueSize
+}
+
+func (h *Handler) serveGet(w http.ResponseWriter, r *http.Request, key string) {
+
+	val, ok, err := h.Store.Get(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := etagFor(val)
+	w.Header().Set("ETag", etag)
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" && matchETag(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", h.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+	if r.Method == "GET" {
+		w.Write(val)
+	}
+}
+
+// readBody reads a request body of at most the maximum value size
+func (h *Handler) readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+
+	max := h.maxValueSize()
+	if r.ContentLength > max {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if int64(len(body)) > max {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+
+	return body, true
+}
+
+func (h *Handler) servePut(w http.ResponseWriter, r *http.Request, key string) {
+
+	val, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	defer h.lockKey(key)()
+
+	if !h.checkPreconditions(w, r, key) {
+		return
+	}
+
+	if err := h.Store.Set(key, val); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etagFor(val))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveDelete(w http.ResponseWriter, r *http.Request, key string) {
+
+	defer h.lockKey(key)()
+
+	if !h.checkPreconditions(w, r, key) {
+		return
+	}
+
+	ok, err := h.Store.Delete(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) serveHealth(w http.ResponseWriter, r *http.Request) {
+
+	if p, ok := h.Store.(shardedkv.Pinger); ok {
+		if err := p.Ping(); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method != "HEAD" {
+		io.WriteString(w, "ok\n")
+	}
+}
+
+func (h *Handler) serveBatch(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := h.readBody(w, r)
+	if !ok {
+		return
+	}
+
+	var ops []BatchOp
+	if err := json.Unmarshal(body, &ops); err != nil {
+		http.Error(w, "bad batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+
+		res := &results[i]
+		var err error
+
+		switch {
+		case op.Key == "":
+			err = ErrEmptyKey
+		case op.Op == "get":
+			res.Value, res.Found, err = h.Store.Get(op.Key)
+		case op.Op == "set":
+			unlock := h.lockKey(op.Key)
+			err = h.Store.Set(op.Key, op.Value)
+			unlock()
+		case op.Op == "delete":
+			unlock := h.lockKey(op.Key)
+			res.Found, err = h.Store.Delete(op.Key)
+			unlock()
+		default:
+			err = errors.New("unknown op " + strconv.Quote(op.Op))
+		}
+
+		if err != nil {
+			res.Error = err.Error()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
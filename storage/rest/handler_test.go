@@ -0,0 +1,325 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/choosers/chash"
+	"github.com/dgryski/go-shardedkv/storage/memory"
+	"github.com/dgryski/go-shardedkv/storagetest"
+)
+
+// a storage whose operations fail with err
+type errStore struct {
+	err error
+}
+
+func (e errStore) Get(key string) ([]byte, bool, error) { return nil, false, e.err }
+func (e errStore) Set(key string, val []byte) error     { return e.err }
+func (e errStore) Delete(key string) (bool, error)      { return false, e.err }
+func (e errStore) ResetConnection(key string) error     { return nil }
+func (e errStore) Ping() error                          { return e.err }
+
+func TestHandler(t *testing.T) {
+
+	ts := httptest.NewServer(&Handler{Store: memory.New()})
+	defer ts.Close()
+
+	s := New(ts.URL)
+	storagetest.StorageTest(t, s)
+
+	if err := s.Ping(); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+
+	// keys which need escaping
+	for _, k := range []string{"with/slash", "with space", "query?a=b", "100%"} {
+		s.Set(k, []byte(k))
+		if v, ok, err := s.Get(k); err != nil || !ok || string(v) != k {
+			t.Errorf("Get(%q)=(%q,%v,%v)", k, v, ok, err)
+		}
+	}
+
+	// the empty key would be the root, which isn't the health endpoint
+	if err := s.Set("", []byte("x")); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Set of the empty key: got %v, want ErrEmptyKey", err)
+	}
+	if _, _, err := s.Get(""); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Get of the empty key: got %v, want ErrEmptyKey", err)
+	}
+
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		req, _ := http.NewRequest(method, ts.URL+"/", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s /: %v", method, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s / returned %d, want 400", method, resp.StatusCode)
+		}
+	}
+
+	results, err := s.Batch([]BatchOp{{Op: "set", Key: "", Value: []byte("x")}})
+	if err != nil || results[0].Error == "" {
+		t.Errorf("batch set of the empty key=(%+v,%v), want an error result", results, err)
+	}
+}
+
+func TestHandlerKVStore(t *testing.T) {
+
+	var shards []shardedkv.Shard
+	for i := 0; i < 3; i++ {
+		shards = append(shards, shardedkv.Shard{Name: "shard" + strconv.Itoa(i), Backend: memory.New()})
+	}
+	kv := shardedkv.New(chash.New(), shards)
+
+	ts := httptest.NewServer(&Handler{Store: kv, Unescape: Base64Unescape})
+	defer ts.Close()
+
+	s := NewWithOptions(ts.URL, Options{Escape: Base64Escape})
+	storagetest.StorageTest(t, s)
+
+	for i := 0; i < 100; i++ {
+		k := "key/" + strconv.Itoa(i)
+		s.Set(k, []byte(k))
+	}
+
+	for i := 0; i < 100; i++ {
+		k := "key/" + strconv.Itoa(i)
+		if v, ok, err := kv.Get(k); err != nil || !ok || string(v) != k {
+			t.Errorf("kv.Get(%q)=(%q,%v,%v)", k, v, ok, err)
+		}
+	}
+}
+
+func TestHandlerErrors(t *testing.T) {
+
+	tests := []struct {
+		err  error
+		kind error
+	}{
+		{shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("down")), shardedkv.ErrUnavailable},
+		{shardedkv.NewError(shardedkv.ErrTimeout, errors.New("slow")), shardedkv.ErrTimeout},
+		{shardedkv.NewError(shardedkv.ErrConflict, errors.New("conflict")), shardedkv.ErrConflict},
+		{shardedkv.NewError(shardedkv.ErrTooLarge, errors.New("big")), shardedkv.ErrTooLarge},
+		{shardedkv.NewError(shardedkv.ErrInvalid, errors.New("bad key")), shardedkv.ErrInvalid},
+		{shardedkv.NewError(shardedkv.ErrRejected, errors.New("shed")), shardedkv.ErrRejected},
+		{errors.New("unknown"), shardedkv.ErrUnavailable},
+	}
+
+	kinds := []error{shardedkv.ErrUnavailable, shardedkv.ErrTimeout, shardedkv.ErrConflict, shardedkv.ErrTooLarge, shardedkv.ErrInvalid, shardedkv.ErrRejected, shardedkv.ErrNotFound}
+
+	for _, tt := range tests {
+		ts := httptest.NewServer(&Handler{Store: errStore{tt.err}})
+		s := New(ts.URL)
+
+		// the error comes back as the same kind, and no other
+		err := s.Set("foo", nil)
+		for _, kind := range kinds {
+			if got := errors.Is(err, kind); got != (kind == tt.kind) {
+				t.Errorf("errors.Is(Set with store error %v, %v)=%v", tt.err, kind, got)
+			}
+		}
+
+		if _, _, err := s.Get("foo"); !errors.Is(err, tt.kind) {
+			t.Errorf("Get with store error %v: got %v, want %v", tt.err, err, tt.kind)
+		}
+		if err := s.Set("foo", nil); !errors.Is(err, tt.kind) {
+			t.Errorf("Set with store error %v: got %v, want %v", tt.err, err, tt.kind)
+		}
+		if _, err := s.Delete("foo"); !errors.Is(err, tt.kind) {
+			t.Errorf("Delete with store error %v: got %v, want %v", tt.err, err, tt.kind)
+		}
+
+		ts.Close()
+	}
+
+	// Get and Delete report a missing key with a false bool, so ErrNotFound only comes back from Set
+	ts := httptest.NewServer(&Handler{Store: errStore{shardedkv.NewError(shardedkv.ErrNotFound, errors.New("missing"))}})
+	if err := New(ts.URL).Set("foo", nil); !errors.Is(err, shardedkv.ErrNotFound) {
+		t.Errorf("Set with store error ErrNotFound: got %v, want ErrNotFound", err)
+	}
+	ts.Close()
+
+	// values over the limit are rejected
+	ts = httptest.NewServer(&Handler{Store: memory.New(), MaxValueSize: 10})
+	defer ts.Close()
+
+	s := New(ts.URL)
+	if err := s.Set("foo", make([]byte, 11)); !errors.Is(err, shardedkv.ErrTooLarge) {
+		t.Errorf("Set of a large value: got %v, want ErrTooLarge", err)
+	}
+	if err := s.Set("foo", make([]byte, 10)); err != nil {
+		t.Errorf("Set of a value at the limit: %v", err)
+	}
+}
+
+func TestHandlerBatch(t *testing.T) {
+
+	ts := httptest.NewServer(&Handler{Store: memory.New()})
+	defer ts.Close()
+
+	s := New(ts.URL)
+	s.Set("deleteme", []byte("x"))
+
+	results, err := s.Batch([]BatchOp{
+		{Op: "set", Key: "foo", Value: []byte("bar")},
+		{Op: "get", Key: "foo"},
+		{Op: "get", Key: "missing"},
+		{Op: "delete", Key: "deleteme"},
+		{Op: "frobnicate", Key: "foo"},
+	})
+	if err != nil {
+		t.Fatalf("Batch: %v", err)
+	}
+
+	if results[0].Error != "" || string(results[1].Value) != "bar" || !results[1].Found ||
+		results[2].Found || !results[3].Found || results[4].Error == "" {
+		t.Errorf("unexpected batch results: %+v", results)
+	}
+
+	resp, err := http.Post(ts.URL+BatchPath, "application/json", strings.NewReader("not json"))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("bad batch returned %d, want 400", resp.StatusCode)
+	}
+}
+
+func TestHandlerHealth(t *testing.T) {
+
+	ts := httptest.NewServer(&Handler{Store: memory.New()})
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + HealthPath)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health of a memory store returned %d, want 200", resp.StatusCode)
+	}
+
+	down := httptest.NewServer(&Handler{Store: errStore{errors.New("down")}})
+	defer down.Close()
+
+	resp, err = http.Get(down.URL + HealthPath)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 500 {
+		t.Errorf("health of a failing store returned %d, want a server error", resp.StatusCode)
+	}
+
+	if err := New(down.URL).Ping(); err == nil {
+		t.Errorf("Ping of a failing store succeeded")
+	}
+}
+
+func TestETags(t *testing.T) {
+
+	ts := httptest.NewServer(&Handler{Store: memory.New()})
+	defer ts.Close()
+
+	s := New(ts.URL)
+
+	etag, err := s.SetIf("foo", []byte("one"), "")
+	if err != nil || etag == "" {
+		t.Fatalf("SetIf of a new key=(%q,%v)", etag, err)
+	}
+
+	if _, err := s.SetIf("foo", []byte("two"), ""); !errors.Is(err, shardedkv.ErrConflict) {
+		t.Errorf("SetIf of an existing key with no ETag: got %v, want ErrConflict", err)
+	}
+
+	v, getTag, ok, err := s.GetETag("foo")
+	if err != nil || !ok || string(v) != "one" || getTag != etag {
+		t.Errorf("GetETag(foo)=(%q,%q,%v,%v), want (one,%q,true,nil)", v, getTag, ok, err, etag)
+	}
+
+	newTag, err := s.SetIf("foo", []byte("two"), etag)
+	if err != nil || newTag == etag {
+		t.Errorf("SetIf with the current ETag=(%q,%v)", newTag, err)
+	}
+
+	// etag is out of date now
+	if _, err := s.SetIf("foo", []byte("three"), etag); !errors.Is(err, shardedkv.ErrConflict) {
+		t.Errorf("SetIf with a stale ETag: got %v, want ErrConflict", err)
+	}
+	if _, err := s.DeleteIf("foo", etag); !errors.Is(err, shardedkv.ErrConflict) {
+		t.Errorf("DeleteIf with a stale ETag: got %v, want ErrConflict", err)
+	}
+
+	if ok, err := s.DeleteIf("foo", newTag); !ok || err != nil {
+		t.Errorf("DeleteIf with the current ETag=(%v,%v), want (true,nil)", ok, err)
+	}
+
+	if ok, err := s.Delete("foo"); ok || err != nil {
+		t.Errorf("Delete of a deleted key=(%v,%v), want (false,nil)", ok, err)
+	}
+
+	// GET honours If-None-Match
+	s.Set("foo", []byte("bar"))
+	_, etag, _, _ = s.GetETag("foo")
+	req, _ := http.NewRequest("GET", ts.URL+"/foo", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with a matching If-None-Match returned %d, want 304", resp.StatusCode)
+	}
+}
+
+func TestETagsConcurrent(t *testing.T) {
+
+	ts := httptest.NewServer(&Handler{Store: memory.New()})
+	defer ts.Close()
+
+	s := New(ts.URL)
+	s.Set("counter", []byte("0"))
+
+	// concurrent increments with compare-and-set retries shouldn't lose any updates
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 5; j++ {
+				for {
+					v, etag, _, err := s.GetETag("counter")
+					if err != nil {
+						t.Errorf("GetETag: %v", err)
+						return
+					}
+					n, _ := strconv.Atoi(string(v))
+					_, err = s.SetIf("counter", []byte(strconv.Itoa(n+1)), etag)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, shardedkv.ErrConflict) {
+						t.Errorf("SetIf: %v", err)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if v, _, _ := s.Get("counter"); string(v) != "50" {
+		t.Errorf("counter=%s after 50 increments", v)
+	}
+}
@@ -3,92 +3,398 @@ package rest
 
 import (
 	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
 )
 
+// DefaultContentType is the content type of values sent to the server
+const DefaultContentType = "application/octet-stream"
+
+// An Escaper encodes a key as a URL path segment
+type Escaper func(key string) string
+
+// PathEscape percent-encodes the key, including any slashes
+func PathEscape(key string) string { return url.PathEscape(key) }
+
+// NoEscape uses the key unchanged.  Keys with slashes map to nested paths.
+func NoEscape(key string) string { return key }
+
+// Base64Escape encodes the key with unpadded URL-safe base64
+func Base64Escape(key string) string { return base64.RawURLEncoding.EncodeToString([]byte(key)) }
+
+// HexEscape encodes the key in hex
+func HexEscape(key string) string { return hex.EncodeToString([]byte(key)) }
+
+// Options configures a Storage
+type Options struct {
+	// The HTTP client.  Default http.DefaultClient.
+	Client *http.Client
+	// Escape encodes keys into the URL.  Default PathEscape.
+	Escape Escaper
+	// Header is added to every request
+	Header http.Header
+	// If BearerToken is set, requests are sent with it in an Authorization header
+	BearerToken string
+	// If Username is set, requests use basic auth
+	Username string
+	Password string
+	// The content type of values, sent as Content-Type for Set and Accept for Get.  Default DefaultContentType.
+	ContentType string
+}
+
 type Storage struct {
 	base   string
 	client *http.Client
+	opts   Options
+}
+
+// ErrClient is the kind of error for a request the server rejected as
+// invalid.  It is shardedkv.ErrInvalid, so wrappers such as backoff don't
+// count it as a failure of the server.
+var ErrClient = shardedkv.ErrInvalid
+
+// ErrEmptyKey is returned for the empty key, whose path would be the root of the API
+var ErrEmptyKey = shardedkv.NewError(ErrClient, errors.New("rest: empty key"))
+
+// StatusError is an unsuccessful HTTP response
+type StatusError struct {
+	Code int
+
+	retryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("rest: %d %s", e.Code, http.StatusText(e.Code))
+}
+
+// RetryAfter returns how long the server asked us to wait before retrying, from the Retry-After header
+func (e *StatusError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// for mocking during testing
+var timeNow = time.Now
+
+// parseRetryAfter parses a Retry-After header, which is either a number of seconds or a date
+func parseRetryAfter(h string) time.Duration {
+
+	if h == "" {
+		return 0
+	}
+
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+
+	if t, err := http.ParseTime(h); err == nil {
+		if d := t.Sub(timeNow()); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// statusError returns an error for an unsuccessful HTTP response, classified with the shardedkv error kinds
+func statusError(resp *http.Response) error {
+
+	code := resp.StatusCode
+	err := &StatusError{Code: code}
+
+	if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+		err.retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	}
+
+	switch {
+	case code == http.StatusNotFound:
+		return shardedkv.NewError(shardedkv.ErrNotFound, err)
+	case code == http.StatusConflict || code == http.StatusPreconditionFailed:
+		return shardedkv.NewError(shardedkv.ErrConflict, err)
+	case code == http.StatusRequestEntityTooLarge || code == http.StatusRequestURITooLong:
+		return shardedkv.NewError(shardedkv.ErrTooLarge, err)
+	case code == http.StatusRequestTimeout || code == http.StatusGatewayTimeout:
+		return shardedkv.NewError(shardedkv.ErrTimeout, err)
+	case code == http.StatusTooManyRequests:
+		// the server shed the request, as Handler does for shardedkv.ErrRejected
+		return shardedkv.NewError(shardedkv.ErrRejected, err)
+	case code >= 500:
+		return shardedkv.NewError(shardedkv.ErrUnavailable, err)
+	case code >= 400 && code < 500:
+		return shardedkv.NewError(ErrClient, err)
+	}
+
+	return err
+}
+
+// the most of an unwanted response body we'll read so the connection can be reused
+const maxDrain = 64 << 10
+
+// drain reads the rest of a response body and closes it, so the connection can be reused
+func drain(resp *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDrain))
+	resp.Body.Close()
+}
+
+// transportError classifies an error from the HTTP client
+func transportError(err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return shardedkv.NewError(shardedkv.ErrTimeout, err)
+	}
+
+	return shardedkv.NewError(shardedkv.ErrUnavailable, err)
 }
 
 // New returns a rest-backed storage at the given base URL using the default HTTP client
 func New(base string) *Storage {
-	return NewWithClient(base, http.DefaultClient)
+	return NewWithOptions(base, Options{})
 }
 
 // New returns a rest-backed storage at the given base URL using a custom HTTP client
 func NewWithClient(base string, client *http.Client) *Storage {
+	return NewWithOptions(base, Options{Client: client})
+}
+
+// NewWithOptions returns a rest-backed storage at the given base URL configured by opts
+func NewWithOptions(base string, opts Options) *Storage {
+
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Escape == nil {
+		opts.Escape = PathEscape
+	}
+	if opts.ContentType == "" {
+		opts.ContentType = DefaultContentType
+	}
+
 	return &Storage{
-		base:   base,
-		client: client,
+		base:   strings.TrimSuffix(base, "/"),
+		client: opts.Client,
+		opts:   opts,
 	}
 }
 
+// keyPath returns the path of the resource for key
+func (s *Storage) keyPath(key string) string {
+	return "/" + s.opts.Escape(key)
+}
+
+// newRequest returns a request for the resource at path, with the configured headers and auth
+func (s *Storage) newRequest(method, path string, body io.Reader) (*http.Request, error) {
+
+	req, err := http.NewRequest(method, s.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range s.opts.Header {
+		req.Header[k] = v
+	}
+
+	if s.opts.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.opts.BearerToken)
+	} else if s.opts.Username != "" {
+		req.SetBasicAuth(s.opts.Username, s.opts.Password)
+	}
+
+	return req, nil
+}
+
 func (s *Storage) Get(key string) ([]byte, bool, error) {
+	val, _, ok, err := s.get(key)
+	return val, ok, err
+}
+
+// get returns the value for key and its ETag
+func (s *Storage) get(key string) ([]byte, string, bool, error) {
+
+	if key == "" {
+		return nil, "", false, ErrEmptyKey
+	}
+
+	req, err := s.newRequest("GET", s.keyPath(key), nil)
+	if err != nil {
+		return nil, "", false, err
+	}
+	req.Header.Set("Accept", s.opts.ContentType)
 
-	resp, err := s.client.Get(s.base + "/" + key)
-	if err != nil || resp.StatusCode >= 400 {
-		// TODO(dgryski): handle 404 vs. other errors
-		return nil, false, err
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, "", false, transportError(err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		drain(resp)
+		return nil, "", false, nil
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		drain(resp)
+		return nil, "", false, statusError(resp)
 	}
 
 	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, false, err
+		return nil, "", false, transportError(err)
 	}
 
-	return body, true, nil
+	return body, resp.Header.Get("ETag"), true, nil
 }
 
 func (s *Storage) Set(key string, val []byte) error {
+	_, err := s.set(key, val, nil)
+	return err
+}
+
+// set stores val with the conditional headers in cond, and returns the new ETag
+func (s *Storage) set(key string, val []byte, cond http.Header) (string, error) {
 
-	req, err := http.NewRequest("PUT", s.base+"/"+key, bytes.NewReader(val))
+	if key == "" {
+		return "", ErrEmptyKey
+	}
+
+	req, err := s.newRequest("PUT", s.keyPath(key), bytes.NewReader(val))
 	if err != nil {
-		return err
+		return "", err
+	}
+	req.Header.Set("Content-Type", s.opts.ContentType)
+	for k, v := range cond {
+		req.Header[k] = v
 	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return err
+		return "", transportError(err)
 	}
-	resp.Body.Close()
+	drain(resp)
 
 	// any status code 200..299 is "success", so fail on anything else
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return errors.New(http.StatusText(resp.StatusCode))
+		return "", statusError(resp)
 	}
 
-	return nil
+	return resp.Header.Get("ETag"), nil
 }
 
 func (s *Storage) Delete(key string) (bool, error) {
+	return s.del(key, nil)
+}
 
-	req, err := http.NewRequest("DELETE", s.base+"/"+key, nil)
+// del deletes key with the conditional headers in cond
+func (s *Storage) del(key string, cond http.Header) (bool, error) {
+
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+
+	req, err := s.newRequest("DELETE", s.keyPath(key), nil)
 	if err != nil {
 		return false, err
 	}
+	for k, v := range cond {
+		req.Header[k] = v
+	}
 
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return false, err
+		return false, transportError(err)
 	}
-	resp.Body.Close()
+	drain(resp)
 
 	if resp.StatusCode == http.StatusNotFound {
 		// XXX this is necessary to conform to the actual behaviour of other storage engines
 		return false, nil
 	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return false, errors.New(http.StatusText(resp.StatusCode))
+		return false, statusError(resp)
 	}
 
-	// we can't know if the file was there -- DELETE is defined to be idempotent and return OK regardless
+	// a server may return OK whether or not the key was there, as DELETE is
+	// idempotent; Handler returns 404 for missing keys so we can tell
 	return true, nil
 }
 
+// Ping implements shardedkv.Pinger by sending HEAD to HealthPath.  Any
+// response other than a server error means the API is reachable, so servers
+// other than Handler may answer 404.
+func (s *Storage) Ping() error {
+
+	req, err := s.newRequest("HEAD", HealthPath, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return transportError(err)
+	}
+	drain(resp)
+
+	if resp.StatusCode >= 500 {
+		return statusError(resp)
+	}
+
+	return nil
+}
+
+// Batch sends ops to a server's batch endpoint, as served by Handler, and
+// returns the result of each.  The error is for the request as a whole.
+func (s *Storage) Batch(ops []BatchOp) ([]BatchResult, error) {
+
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := s.newRequest("POST", BatchPath, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, transportError(err)
+	}
+	defer drain(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, statusError(resp)
+	}
+
+	var results []BatchResult
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, transportError(err)
+	}
+
+	if len(results) != len(ops) {
+		return nil, fmt.Errorf("rest: batch of %d operations returned %d results", len(ops), len(results))
+	}
+
+	return results, nil
+}
+
 func (s *Storage) ResetConnection(key string) error {
 	// FIXME(dgryski): Try to clean out cached keep-alive connections the client holds?
 	return nil
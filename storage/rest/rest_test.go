@@ -1,11 +1,18 @@
 package rest
 
 import (
-	"github.com/dgryski/go-shardedkv/storagetest"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/storagetest"
 )
 
 var storage map[string][]byte
@@ -42,3 +49,192 @@ func TestRest(t *testing.T) {
 	r := New(ts.URL)
 	storagetest.StorageTest(t, r)
 }
+
+var _ shardedkv.Pinger = &Storage{}
+
+func TestStatusError(t *testing.T) {
+
+	tests := []struct {
+		code int
+		kind error
+	}{
+		{http.StatusNotFound, shardedkv.ErrNotFound},
+		{http.StatusConflict, shardedkv.ErrConflict},
+		{http.StatusRequestEntityTooLarge, shardedkv.ErrTooLarge},
+		{http.StatusGatewayTimeout, shardedkv.ErrTimeout},
+		{http.StatusTooManyRequests, shardedkv.ErrRejected},
+		{http.StatusInternalServerError, shardedkv.ErrUnavailable},
+		{http.StatusBadRequest, ErrClient},
+		{http.StatusForbidden, ErrClient},
+	}
+
+	for _, tt := range tests {
+		err := statusError(&http.Response{StatusCode: tt.code, Header: http.Header{}})
+		for _, kind := range []error{shardedkv.ErrNotFound, shardedkv.ErrConflict, shardedkv.ErrTooLarge, shardedkv.ErrTimeout, shardedkv.ErrUnavailable, shardedkv.ErrRejected, ErrClient} {
+			if got := errors.Is(err, kind); got != (kind == tt.kind) {
+				t.Errorf("errors.Is(statusError(%d), %v)=%v", tt.code, kind, got)
+			}
+		}
+
+		var serr *StatusError
+		if !errors.As(err, &serr) || serr.Code != tt.code {
+			t.Errorf("statusError(%d) isn't a StatusError with the code: %v", tt.code, err)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+
+	now := time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.header); got != tt.want {
+			t.Errorf("parseRetryAfter(%q)=%v, want %v", tt.header, got, tt.want)
+		}
+	}
+
+	resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{"Retry-After": {"5"}}}
+	var serr *StatusError
+	if !errors.As(statusError(resp), &serr) || serr.RetryAfter() != 5*time.Second {
+		t.Errorf("Retry-After not returned from a 503")
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+
+	var requests, conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Path == "/notfound" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("no such key"))
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("something went wrong"))
+	}))
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	s := New(ts.URL)
+
+	if v, ok, err := s.Get("notfound"); v != nil || ok || err != nil {
+		t.Errorf("Get(notfound)=(%v,%v,%v), want a miss", v, ok, err)
+	}
+
+	if _, ok, err := s.Get("broken"); ok || !errors.Is(err, shardedkv.ErrUnavailable) {
+		t.Errorf("Get on a server error=(%v,%v), want ErrUnavailable", ok, err)
+	}
+
+	if err := s.Set("broken", []byte("x")); !errors.Is(err, shardedkv.ErrUnavailable) {
+		t.Errorf("Set on a server error=%v, want ErrUnavailable", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		s.Get("broken")
+	}
+
+	// the error bodies were drained, so the connection was reused
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("%d requests used %d connections, want 1", atomic.LoadInt32(&requests), n)
+	}
+}
+
+func TestEscape(t *testing.T) {
+
+	keys := []string{"plain", "with/slash", "with space", "query?a=b", "frag#ment", "100%", "../up"}
+
+	for _, escape := range []Escaper{PathEscape, Base64Escape, HexEscape} {
+
+		paths := make(map[string][]byte)
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := r.URL.EscapedPath()
+			if strings.Count(p, "/") != 1 || r.URL.RawQuery != "" {
+				t.Errorf("key escaped to more than one path segment: %s", r.URL)
+			}
+			switch r.Method {
+			case "GET":
+				if v, ok := paths[p]; ok {
+					w.Write(v)
+				} else {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			case "PUT":
+				paths[p], _ = ioutil.ReadAll(r.Body)
+			}
+		}))
+
+		s := NewWithOptions(ts.URL+"/", Options{Escape: escape})
+		for _, k := range keys {
+			if err := s.Set(k, []byte(k)); err != nil {
+				t.Errorf("Set(%q): %v", k, err)
+			}
+		}
+
+		for _, k := range keys {
+			if v, ok, err := s.Get(k); err != nil || !ok || string(v) != k {
+				t.Errorf("Get(%q)=(%q,%v,%v)", k, v, ok, err)
+			}
+		}
+
+		if len(paths) != len(keys) {
+			t.Errorf("%d keys stored at %d paths", len(keys), len(paths))
+		}
+
+		ts.Close()
+	}
+}
+
+func TestHeaders(t *testing.T) {
+
+	var got *http.Request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer ts.Close()
+
+	s := NewWithOptions(ts.URL, Options{
+		Header:      http.Header{"X-Tenant": {"gophers"}},
+		BearerToken: "sekrit",
+		ContentType: "application/json",
+	})
+
+	s.Set("foo", []byte(`{}`))
+	if got.Header.Get("X-Tenant") != "gophers" || got.Header.Get("Authorization") != "Bearer sekrit" || got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("Set sent headers %v", got.Header)
+	}
+
+	s.Get("foo")
+	if got.Header.Get("Accept") != "application/json" {
+		t.Errorf("Get sent Accept %q, want application/json", got.Header.Get("Accept"))
+	}
+
+	s = NewWithOptions(ts.URL, Options{Username: "gopher", Password: "hunter2"})
+	s.Delete("foo")
+	if u, p, ok := got.BasicAuth(); !ok || u != "gopher" || p != "hunter2" {
+		t.Errorf("Delete sent basic auth (%q,%q,%v)", u, p, ok)
+	}
+
+	if got.Header.Get("Content-Type") != "" {
+		t.Errorf("Delete sent a Content-Type")
+	}
+}
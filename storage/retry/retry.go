@@ -0,0 +1,264 @@
+// Package retry implements a storage backend that retries transient failures of another backend.
+/*
+
+Get, Set and Delete are all idempotent, so when one of them fails with an
+error that looks transient (a timeout, or a dropped or refused connection) it
+is retried with exponential backoff and jitter.  If the error looks
+connection-related, the connection is reset before the next attempt.  If the
+server asked for a delay with Retry-After, we wait at least that long, or
+give up if it's longer than MaxDelay.
+
+To prevent retries from amplifying an outage, retries are limited by a
+budget: each request adds BudgetRatio to the budget, each retry spends 1, and
+no retries are made while the budget is empty.  With the default ratio of
+0.1, retries can add at most 10% to the load on the underlying storage.
+
+*/
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+// The default maximum number of retries for a single request
+const DefaultMaxRetries = 3
+
+// The default delay before the first retry
+const DefaultBaseDelay = 10 * time.Millisecond
+
+// The default maximum delay between retries
+const DefaultMaxDelay = 1 * time.Second
+
+// The default number of retries earned by each request
+const DefaultBudgetRatio = 0.1
+
+// The default maximum number of retries which can be saved up in the budget
+const DefaultBudgetCap = 10
+
+// Storage is a storage backend that retries failed requests
+type Storage struct {
+	// The underlying storage backend
+	Store shardedkv.Storage
+	// The maximum number of retries for a single request.  Default 3.
+	MaxRetries int
+	// The delay before the first retry, doubling for each subsequent retry.  Default 10ms.
+	BaseDelay time.Duration
+	// The maximum delay between retries.  Default 1 second.
+	MaxDelay time.Duration
+	// The number of retries earned by each request.  Default 0.1.
+	BudgetRatio float64
+	// The maximum number of retries which can be saved up.  Default 10.
+	BudgetCap float64
+
+	// IsRetriable reports whether a request which failed with err should
+	// be retried.  Default IsTransient.
+	IsRetriable func(err error) bool
+
+	mu     sync.Mutex
+	budget float64
+	// the budget starts out full, so we need to know if it's been filled
+	filled bool
+}
+
+// for mocking during testing
+var sleep = time.Sleep
+var randInt63n = rand.Int63n
+
+// IsConnectionError reports whether err looks like the connection to the storage was lost or couldn't be made
+func IsConnectionError(err error) bool {
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	var operr *net.OpError
+	return errors.As(err, &operr)
+}
+
+// IsTransient reports whether err is a connection error or a timeout, or is
+// classified as shardedkv.ErrUnavailable or ErrTimeout, which are likely to
+// succeed if retried.  Cancelled requests are never retried.
+func IsTransient(err error) bool {
+
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if shardedkv.IsRetriable(err) || IsConnectionError(err) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr) && nerr.Timeout()
+}
+
+// retryAfter returns how long the server asked us to wait before retrying,
+// for errors with a RetryAfter method such as rest.StatusError
+func retryAfter(err error) time.Duration {
+
+	var ra interface{ RetryAfter() time.Duration }
+	if errors.As(err, &ra) {
+		return ra.RetryAfter()
+	}
+
+	return 0
+}
+
+// deposit adds a request's contribution to the retry budget
+func (s *Storage) deposit() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	budgetCap := s.BudgetCap
+	if budgetCap == 0 {
+		budgetCap = DefaultBudgetCap
+	}
+
+	if !s.filled {
+		s.budget = budgetCap
+		s.filled = true
+	}
+
+	ratio := s.BudgetRatio
+	if ratio == 0 {
+		ratio = DefaultBudgetRatio
+	}
+
+	s.budget += ratio
+	if s.budget > budgetCap {
+		s.budget = budgetCap
+	}
+}
+
+// withdraw spends one retry from the budget, and reports if there was one to spend
+func (s *Storage) withdraw() bool {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.budget < 1 {
+		return false
+	}
+
+	s.budget--
+	return true
+}
+
+// delay returns the jittered delay before retry number attempt
+func (s *Storage) delay(attempt int) time.Duration {
+
+	d := s.BaseDelay
+	if d == 0 {
+		d = DefaultBaseDelay
+	}
+
+	maxDelay := s.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	for i := 0; i < attempt && d < maxDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxDelay {
+		d = maxDelay
+	}
+
+	// "full jitter": sleep a random time up to the backoff delay
+	return time.Duration(randInt63n(int64(d) + 1))
+}
+
+// do calls op, retrying it while it fails with retriable errors
+func (s *Storage) do(key string, op func() error) error {
+
+	isRetriable := s.IsRetriable
+	if isRetriable == nil {
+		isRetriable = IsTransient
+	}
+
+	maxRetries := s.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+
+	maxDelay := s.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = DefaultMaxDelay
+	}
+
+	s.deposit()
+
+	err := op()
+
+	// if the server wants us to wait longer than MaxDelay, give up
+	for attempt := 0; err != nil && attempt < maxRetries && isRetriable(err) && retryAfter(err) <= maxDelay && s.withdraw(); attempt++ {
+
+		if IsConnectionError(err) {
+			// the error that matters is the one from the retry
+			s.Store.ResetConnection(key)
+		}
+
+		d := s.delay(attempt)
+		if ra := retryAfter(err); ra > d {
+			d = ra
+		}
+
+		sleep(d)
+
+		err = op()
+	}
+
+	return err
+}
+
+// Get implements the shardedkv.Storage interface
+func (s *Storage) Get(key string) ([]byte, bool, error) {
+
+	var val []byte
+	var ok bool
+
+	err := s.do(key, func() error {
+		var err error
+		val, ok, err = s.Store.Get(key)
+		return err
+	})
+
+	return val, ok, err
+}
+
+// Set implements the shardedkv.Storage interface
+func (s *Storage) Set(key string, value []byte) error {
+	return s.do(key, func() error { return s.Store.Set(key, value) })
+}
+
+// Delete implements the shardedkv.Storage interface
+func (s *Storage) Delete(key string) (bool, error) {
+
+	var ok bool
+
+	err := s.do(key, func() error {
+		var err error
+		ok, err = s.Store.Delete(key)
+		return err
+	})
+
+	return ok, err
+}
+
+// ResetConnection implements the shardedkv.Storage interface
+func (s *Storage) ResetConnection(key string) error {
+	return s.Store.ResetConnection(key)
+}
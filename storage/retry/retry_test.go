@@ -0,0 +1,123 @@
+package retry
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/storage/memory"
+	"github.com/dgryski/go-shardedkv/storagetest"
+)
+
+// a storage whose gets fail with err the first fails times
+type failStore struct {
+	*memory.Storage
+	err    error
+	fails  int
+	gets   int
+	resets int
+}
+
+func (f *failStore) Get(key string) ([]byte, bool, error) {
+	f.gets++
+	if f.gets <= f.fails {
+		return nil, false, f.err
+	}
+	return f.Storage.Get(key)
+}
+
+func (f *failStore) ResetConnection(key string) error {
+	f.resets++
+	return nil
+}
+
+func TestRetry(t *testing.T) {
+	r := &Storage{Store: memory.New()}
+	storagetest.StorageTest(t, r)
+}
+
+func TestTransient(t *testing.T) {
+	defer func() { sleep = time.Sleep }()
+	sleep = func(time.Duration) {}
+
+	f := &failStore{Storage: memory.New(), err: io.EOF, fails: 2}
+	r := &Storage{Store: f}
+
+	if _, _, err := r.Get("foo"); err != nil {
+		t.Errorf("transient error not retried: %v", err)
+	}
+
+	if f.gets != 3 || f.resets != 2 {
+		t.Errorf("gets=%d resets=%d, want 3 and 2", f.gets, f.resets)
+	}
+
+	f = &failStore{Storage: memory.New(), err: errors.New("permanent"), fails: 2}
+	r = &Storage{Store: f}
+
+	if _, _, err := r.Get("foo"); err == nil {
+		t.Errorf("permanent error was retried")
+	}
+
+	if f.gets != 1 || f.resets != 0 {
+		t.Errorf("gets=%d resets=%d, want 1 and 0", f.gets, f.resets)
+	}
+
+	if IsTransient(shardedkv.NewError(shardedkv.ErrRejected, errors.New("shed"))) {
+		t.Errorf("a locally rejected request is transient")
+	}
+}
+
+func TestBudget(t *testing.T) {
+	defer func() { sleep = time.Sleep }()
+	sleep = func(time.Duration) {}
+
+	f := &failStore{Storage: memory.New(), err: io.EOF, fails: 1000}
+	r := &Storage{Store: f, MaxRetries: 1, BudgetRatio: 0.5, BudgetCap: 2}
+
+	for i := 0; i < 100; i++ {
+		r.Get("foo")
+	}
+
+	// two retries from the initial budget, and one for every two requests
+	// after that, less the rounding from the cap
+	if retries := f.gets - 100; retries > 52 {
+		t.Errorf("%d retries for 100 requests, budget allows at most 52", retries)
+	}
+}
+
+var _ shardedkv.Storage = &Storage{}
+
+// an error asking for a retry after a delay, like rest.StatusError
+type retryAfterError time.Duration
+
+func (e retryAfterError) Error() string             { return "slow down" }
+func (e retryAfterError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func TestRetryAfter(t *testing.T) {
+	defer func() { sleep = time.Sleep }()
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+
+	err := shardedkv.NewError(shardedkv.ErrUnavailable, retryAfterError(500*time.Millisecond))
+	f := &failStore{Storage: memory.New(), err: err, fails: 1}
+	r := &Storage{Store: f}
+
+	if _, _, err := r.Get("foo"); err != nil {
+		t.Errorf("Retry-After error not retried: %v", err)
+	}
+
+	if len(slept) != 1 || slept[0] != 500*time.Millisecond {
+		t.Errorf("slept %v, want [500ms]", slept)
+	}
+
+	// too long to wait
+	err = shardedkv.NewError(shardedkv.ErrUnavailable, retryAfterError(time.Minute))
+	f = &failStore{Storage: memory.New(), err: err, fails: 1}
+	r = &Storage{Store: f}
+
+	if _, _, err := r.Get("foo"); err == nil || f.gets != 1 {
+		t.Errorf("retried after a Retry-After longer than MaxDelay: gets=%d err=%v", f.gets, err)
+	}
+}
@@ -0,0 +1,105 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A Dialect generates the SQL for a particular database
+type Dialect interface {
+	// Placeholder returns the placeholder for the nth parameter of a query, counting from 1
+	Placeholder(n int) string
+	// Upsert returns a statement which inserts a row, or replaces its value
+	// columns if the key is already present.  The parameters are the key
+	// followed by the values.
+	Upsert(table, keyColumn string, valueColumns []string) string
+	// BlobType returns the column type for values
+	BlobType() string
+	// UniqueColumns returns a query listing the columns of the table which
+	// are a primary key or unique index on their own, one per row
+	UniqueColumns(table string) string
+}
+
+// The supported dialects
+var (
+	SQLite   Dialect = sqlite{}
+	MySQL    Dialect = mysql{}
+	Postgres Dialect = postgres{}
+)
+
+type sqlite struct{}
+
+func (sqlite) Placeholder(n int) string { return "?" }
+func (sqlite) BlobType() string         { return "BLOB" }
+
+// UniqueColumns uses the pragma functions, and also lists an INTEGER PRIMARY KEY, which has no index of its own
+func (sqlite) UniqueColumns(table string) string {
+	t := quote(table)
+	return "SELECT ii.name FROM pragma_index_list(" + t + ") il, pragma_index_info(il.name) ii" +
+		" WHERE il.\"unique\" = 1 AND (SELECT COUNT(*) FROM pragma_index_info(il.name)) = 1" +
+		" UNION SELECT name FROM pragma_table_info(" + t + ") WHERE pk = 1 AND (SELECT COUNT(*) FROM pragma_table_info(" + t + ") WHERE pk > 0) = 1"
+}
+
+// Upsert uses INSERT OR REPLACE, which works with versions of SQLite before ON CONFLICT was added
+func (d sqlite) Upsert(table, keyColumn string, valueColumns []string) string {
+	return "INSERT OR REPLACE" + insert(d, table, keyColumn, valueColumns)
+}
+
+type mysql struct{}
+
+func (mysql) Placeholder(n int) string { return "?" }
+func (mysql) BlobType() string         { return "LONGBLOB" }
+
+func (mysql) UniqueColumns(table string) string {
+	return "SELECT MIN(COLUMN_NAME) FROM information_schema.STATISTICS" +
+		" WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = " + quote(table) + " AND NON_UNIQUE = 0" +
+		" GROUP BY INDEX_NAME HAVING COUNT(*) = 1"
+}
+
+func (d mysql) Upsert(table, keyColumn string, valueColumns []string) string {
+
+	var set []string
+	for _, c := range valueColumns {
+		set = append(set, c+" = VALUES("+c+")")
+	}
+
+	return "INSERT" + insert(d, table, keyColumn, valueColumns) + " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+}
+
+type postgres struct{}
+
+func (postgres) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+func (postgres) BlobType() string         { return "BYTEA" }
+
+func (postgres) UniqueColumns(table string) string {
+	return "SELECT a.attname FROM pg_index i JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]" +
+		" WHERE i.indrelid = " + quote(table) + "::regclass AND i.indisunique AND i.indnatts = 1"
+}
+
+func (d postgres) Upsert(table, keyColumn string, valueColumns []string) string {
+
+	var set []string
+	for _, c := range valueColumns {
+		set = append(set, c+" = EXCLUDED."+c)
+	}
+
+	return "INSERT" + insert(d, table, keyColumn, valueColumns) + " ON CONFLICT (" + keyColumn + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+// quote returns s as an SQL string literal
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// insert returns the part of an INSERT statement after the verb
+func insert(d Dialect, table, keyColumn string, valueColumns []string) string {
+
+	columns := append([]string{keyColumn}, valueColumns...)
+
+	var params []string
+	for i := range columns {
+		params = append(params, d.Placeholder(i+1))
+	}
+
+	return " INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + strings.Join(params, ", ") + ")"
+}
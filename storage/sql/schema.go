@@ -0,0 +1,165 @@
+package sql
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultKeySize is the default maximum length of a key in a table created by EnsureTable
+const DefaultKeySize = 255
+
+// ErrSchema is the kind of error returned when a table doesn't match its TableConfig
+var ErrSchema = errors.New("sql: table doesn't match TableConfig")
+
+// createTable returns the statement creating the table described by config
+func createTable(d Dialect, config *TableConfig) string {
+
+	keySize := config.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+
+	columns := []string{fmt.Sprintf("%s VARCHAR(%d) NOT NULL PRIMARY KEY", config.KeyColumn, keySize)}
+
+	for _, c := range valueColumns(config) {
+		columns = append(columns, c+" "+d.BlobType())
+	}
+
+	for _, c := range optionalColumns(config) {
+		columns = append(columns, c[0]+" "+c[1])
+	}
+
+	return "CREATE TABLE IF NOT EXISTS " + config.Table + " (\n\t" + strings.Join(columns, ",\n\t") + "\n)"
+}
+
+// optionalColumns returns the name and definition of the expiry and version columns, if they're configured
+func optionalColumns(config *TableConfig) [][2]string {
+
+	var columns [][2]string
+	if config.ExpiryColumn != "" {
+		columns = append(columns, [2]string{config.ExpiryColumn, "BIGINT"})
+	}
+	if config.VersionColumn != "" {
+		columns = append(columns, [2]string{config.VersionColumn, "BIGINT NOT NULL DEFAULT 0"})
+	}
+
+	return columns
+}
+
+// tableColumns returns the names of the columns of the table, lower-cased
+func (s *Storage) tableColumns() (map[string]bool, error) {
+
+	db, done := s.conn()
+	defer done()
+
+	rows, err := db.Query("SELECT * FROM " + s.config.Table + " WHERE 1 = 0")
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return nil, wrapError(err)
+	}
+
+	columns := make(map[string]bool)
+	for _, n := range names {
+		columns[strings.ToLower(n)] = true
+	}
+
+	return columns, nil
+}
+
+// EnsureTable creates the table if it doesn't exist, with the key as its
+// primary key.  If the table exists, the expiry and version columns are added
+// if they're configured but missing, and the table is then checked with
+// ValidateTable.  Those are the only migrations: value columns, and a key
+// which isn't unique, must be fixed by hand.
+func (s *Storage) EnsureTable() error {
+
+	db, done := s.conn()
+	defer done()
+
+	if _, err := db.Exec(createTable(s.dialect, s.config)); err != nil {
+		return wrapError(err)
+	}
+
+	columns, err := s.tableColumns()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range optionalColumns(s.config) {
+		if columns[strings.ToLower(c[0])] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + s.config.Table + " ADD COLUMN " + c[0] + " " + c[1]); err != nil {
+			return wrapError(err)
+		}
+	}
+
+	return s.ValidateTable()
+}
+
+// keyIsUnique reports whether the key column is the primary key or has a unique index of its own
+func (s *Storage) keyIsUnique() (bool, error) {
+
+	db, done := s.conn()
+	defer done()
+
+	rows, err := db.Query(s.dialect.UniqueColumns(s.config.Table))
+	if err != nil {
+		return false, wrapError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil {
+			return false, wrapError(err)
+		}
+		if strings.EqualFold(c, s.config.KeyColumn) {
+			return true, nil
+		}
+	}
+
+	return false, wrapError(rows.Err())
+}
+
+// ValidateTable checks that the table has all the columns named in the
+// TableConfig, and that the key column is its primary key or has a unique
+// index, which the upserts used by Set rely on.  A mismatch is reported as an
+// error wrapping ErrSchema.
+func (s *Storage) ValidateTable() error {
+
+	columns, err := s.tableColumns()
+	if err != nil {
+		return err
+	}
+
+	want := append([]string{s.config.KeyColumn}, writeColumns(s.config)...)
+
+	var missing []string
+	for _, c := range want {
+		if !columns[strings.ToLower(c)] {
+			missing = append(missing, c)
+		}
+	}
+
+	if missing != nil {
+		return fmt.Errorf("%w: %s has no column %s", ErrSchema, s.config.Table, strings.Join(missing, ", "))
+	}
+
+	unique, err := s.keyIsUnique()
+	if err != nil {
+		return err
+	}
+
+	if !unique {
+		return fmt.Errorf("%w: %s has no primary key or unique index on %s", ErrSchema, s.config.Table, s.config.KeyColumn)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+package sql
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv/storagetest"
+)
+
+// tempDB returns a connector for a new sqlite database, and a function to remove it
+func tempDB(t *testing.T) (func() (*sql.DB, error), func()) {
+
+	f, err := ioutil.TempFile(os.TempDir(), "shardedkv-sql-schematest")
+	if err != nil {
+		t.Skipf("unable to create tempfile: %s", err)
+	}
+	f.Close()
+
+	connector := func() (*sql.DB, error) {
+		return sql.Open("sqlite3", f.Name())
+	}
+
+	return connector, func() { os.Remove(f.Name()) }
+}
+
+// queryRow scans the row returned by q from the storage's database into dest
+func queryRow(s *Storage, q string, dest ...interface{}) error {
+	db, done := s.conn()
+	defer done()
+	return db.QueryRow(q).Scan(dest...)
+}
+
+func TestEnsureTable(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	s, err := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v"})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := s.ValidateTable(); err == nil {
+		t.Errorf("ValidateTable of a missing table succeeded")
+	}
+
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+
+	// creating the table again is harmless
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable of an existing table: %v", err)
+	}
+
+	storagetest.StorageTest(t, s)
+
+	// the key is the primary key, so setting it again replaces the row
+	s.Set("foo", []byte("bar"))
+	s.Set("foo", []byte("baz"))
+
+	var n int
+	queryRow(s, "SELECT COUNT(*) FROM kv WHERE k = 'foo'", &n)
+	if n != 1 {
+		t.Errorf("%d rows for one key", n)
+	}
+
+	// a config which doesn't match
+	bad, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "value"})
+	if err := bad.ValidateTable(); !errors.Is(err, ErrSchema) {
+		t.Errorf("ValidateTable with the wrong value column: got %v, want ErrSchema", err)
+	}
+}
+
+func TestMigration(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	old, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v"})
+	if err := old.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+	old.Set("foo", []byte("bar"))
+
+	now := time.Unix(1000000, 0)
+	defer func() { timeNow = time.Now }()
+	timeNow = func() time.Time { return now }
+
+	s, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v", ExpiryColumn: "expires", VersionColumn: "version"})
+	if err := s.ValidateTable(); !errors.Is(err, ErrSchema) {
+		t.Errorf("ValidateTable before the migration: got %v, want ErrSchema", err)
+	}
+
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable adding columns: %v", err)
+	}
+
+	// existing rows don't expire
+	if v, ok, err := s.Get("foo"); err != nil || !ok || string(v) != "bar" {
+		t.Errorf("Get of an existing row=(%q,%v,%v)", v, ok, err)
+	}
+
+	if err := s.SetWithExpiry("temp", []byte("x"), now.Add(time.Minute)); err != nil {
+		t.Fatalf("SetWithExpiry: %v", err)
+	}
+
+	var version int64
+	queryRow(s, "SELECT version FROM kv WHERE k = 'temp'", &version)
+	if version != now.UnixNano() {
+		t.Errorf("version=%d, want %d", version, now.UnixNano())
+	}
+
+	if _, ok, _ := s.Get("temp"); !ok {
+		t.Errorf("value missing before it expired")
+	}
+
+	now = now.Add(time.Hour)
+
+	if _, ok, _ := s.Get("temp"); ok {
+		t.Errorf("value returned after it expired")
+	}
+
+	if n, err := s.DeleteExpired(); n != 1 || err != nil {
+		t.Errorf("DeleteExpired=(%d,%v), want (1,nil)", n, err)
+	}
+
+	if err := old.SetWithExpiry("foo", nil, now); err != ErrNoExpiry {
+		t.Errorf("SetWithExpiry without an expiry column: got %v, want ErrNoExpiry", err)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	db, _ := connector()
+	defer db.Close()
+
+	tests := []struct {
+		create string
+		unique bool
+	}{
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL PRIMARY KEY, v BLOB)", true},
+		{"CREATE TABLE kv (k INTEGER PRIMARY KEY, v BLOB)", true},
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL UNIQUE, v BLOB)", true},
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL, v BLOB); CREATE UNIQUE INDEX kv_k ON kv (k)", true},
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL, v BLOB)", false},
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL, v BLOB); CREATE INDEX kv_k ON kv (k)", false},
+		{"CREATE TABLE kv (k VARCHAR(64) NOT NULL, v BLOB, PRIMARY KEY (k, v))", false},
+		{"CREATE TABLE kv (id INTEGER PRIMARY KEY, k VARCHAR(64) NOT NULL, v BLOB)", false},
+	}
+
+	for _, tt := range tests {
+		db.Exec("DROP TABLE IF EXISTS kv")
+		if _, err := db.Exec(tt.create); err != nil {
+			t.Fatalf("%s: %v", tt.create, err)
+		}
+
+		s, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v"})
+		err := s.ValidateTable()
+		if tt.unique && err != nil {
+			t.Errorf("ValidateTable of %s: %v", tt.create, err)
+		} else if !tt.unique && !errors.Is(err, ErrSchema) {
+			t.Errorf("ValidateTable of %s: got %v, want ErrSchema", tt.create, err)
+		}
+	}
+}
+
+func TestResetConnectionConcurrent(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	s, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v"})
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+	s.Set("foo", []byte("bar"))
+
+	// requests using the old database and statements aren't broken by a reset
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, ok, err := s.Get("foo"); !ok || err != nil {
+					t.Errorf("Get during a reset=(%v,%v)", ok, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := s.ResetConnection("foo"); err != nil {
+			t.Errorf("ResetConnection: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -2,24 +2,39 @@
 package sql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
-)
-
-/*
-TODO(dgryski): support multiple value columns
-    perl has ShardedKV::MySQL->set("foo", ["bar", "baz", "qux"])
-    We can define this as base behaviour and require users to add replacement bits for their tables
-    This requires changing Get/Set to take and return interface{} instead of []byte
-*/
+	"net"
+	"strings"
+	"sync"
+	"time"
 
-// TODO(dgryski): include all other table creation logic
-// TODO(dgryski): cache prepared queries
+	"github.com/dgryski/go-shardedkv"
+)
 
 type Storage struct {
-	db        *sql.DB
 	config    *TableConfig
 	connector func() (*sql.DB, error)
+	dialect   Dialect
+
+	getQuery     string
+	setQuery     string
+	deleteQuery  string
+	expiredQuery string
+
+	mu sync.Mutex
+	p  *pool
+}
+
+// pool is a database and the statements prepared on it.  users counts the
+// requests using it, so ResetConnection can close it once they've finished.
+type pool struct {
+	db    *sql.DB
+	stmts map[string]*sql.Stmt
+	users sync.WaitGroup
 }
 
 // TableConfig is the configuration for the table used for the key-value store
@@ -27,6 +42,46 @@ type TableConfig struct {
 	Table       string
 	KeyColumn   string
 	ValueColumn string
+	// If set, the table has several value columns, used instead of
+	// ValueColumn.  Get and Set convert between []byte values and the columns
+	// with Codec; GetValues and SetValues access the columns directly.
+	ValueColumns []string
+	// The codec for tables with several value columns.  Default JSONCodec.
+	Codec Codec
+	// Optional.  If set, rows whose expiry time, in Unix seconds, has passed aren't returned by Get.
+	ExpiryColumn string
+	// Optional.  If set, Set stores the time of each write, in Unix
+	// nanoseconds, so readers can tell which of two copies of a value is newer.
+	VersionColumn string
+	// The SQL dialect of the database.  Default SQLite.
+	Dialect Dialect
+	// The maximum length of a key in a table created by EnsureTable.  Default DefaultKeySize.
+	KeySize int
+}
+
+// ErrNoExpiry is returned when setting an expiry time on a table without an expiry column
+var ErrNoExpiry = errors.New("sql: TableConfig has no ExpiryColumn")
+
+// for mocking during testing
+var timeNow = time.Now
+
+// wrapError classifies an error from database/sql with the shardedkv error kinds.  Errors from the driver itself are returned unchanged.
+func wrapError(err error) error {
+
+	if err == nil {
+		return nil
+	}
+
+	var nerr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &nerr) && nerr.Timeout()) {
+		return shardedkv.NewError(shardedkv.ErrTimeout, err)
+	}
+
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.As(err, &nerr) {
+		return shardedkv.NewError(shardedkv.ErrUnavailable, err)
+	}
+
+	return err
 }
 
 // New returns a new sql key-value store.  Connector should be a function which
@@ -35,70 +90,195 @@ func New(connector func() (*sql.DB, error), config *TableConfig) (*Storage, erro
 
 	db, err := connector()
 	if err != nil {
-		return nil, err
+		return nil, wrapError(err)
 	}
 
-	return &Storage{
-		db:        db,
+	d := config.Dialect
+	if d == nil {
+		d = SQLite
+	}
+
+	s := &Storage{
+		p:         &pool{db: db, stmts: make(map[string]*sql.Stmt)},
 		connector: connector,
 		config:    config,
-	}, nil
+		dialect:   d,
+
+		getQuery:    fmt.Sprint("SELECT ", strings.Join(valueColumns(config), ", "), " FROM ", config.Table, " WHERE ", config.KeyColumn, " = ", d.Placeholder(1)),
+		setQuery:    d.Upsert(config.Table, config.KeyColumn, writeColumns(config)),
+		deleteQuery: fmt.Sprint("DELETE FROM ", config.Table, " WHERE ", config.KeyColumn, " = ", d.Placeholder(1)),
+	}
+
+	if config.ExpiryColumn != "" {
+		s.getQuery += fmt.Sprint(" AND (", config.ExpiryColumn, " IS NULL OR ", config.ExpiryColumn, " > ", d.Placeholder(2), ")")
+		s.expiredQuery = fmt.Sprint("DELETE FROM ", config.Table, " WHERE ", config.ExpiryColumn, " <= ", d.Placeholder(1))
+	}
+
+	return s, nil
+}
+
+// valueColumns returns the columns holding the value
+func valueColumns(config *TableConfig) []string {
+	if len(config.ValueColumns) > 0 {
+		return config.ValueColumns
+	}
+	return []string{config.ValueColumn}
+}
+
+// writeColumns returns the columns written by Set, other than the key
+func writeColumns(config *TableConfig) []string {
+
+	columns := append([]string(nil), valueColumns(config)...)
+	if config.ExpiryColumn != "" {
+		columns = append(columns, config.ExpiryColumn)
+	}
+	if config.VersionColumn != "" {
+		columns = append(columns, config.VersionColumn)
+	}
+
+	return columns
+}
+
+// conn returns the current database, and the function to call once the caller has finished with it
+func (s *Storage) conn() (*sql.DB, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.p.users.Add(1)
+	return s.p.db, s.p.users.Done
+}
+
+// stmt returns the prepared statement for q, preparing it the first time
+// it's used, and the function to call once the caller has finished with it
+func (s *Storage) stmt(q string) (*sql.Stmt, func(), error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.p
+
+	stmt, ok := p.stmts[q]
+	if !ok {
+		var err error
+		if stmt, err = p.db.Prepare(q); err != nil {
+			return nil, nil, wrapError(err)
+		}
+		p.stmts[q] = stmt
+	}
+
+	p.users.Add(1)
+	return stmt, p.users.Done, nil
 }
 
 func (s *Storage) Get(key string) ([]byte, bool, error) {
 
-	q := fmt.Sprintf("SELECT %s FROM %s where %s = ?", s.config.ValueColumn, s.config.Table, s.config.KeyColumn)
+	if len(s.config.ValueColumns) > 0 {
+		v, ok, err := s.GetValues(key)
+		if !ok || err != nil {
+			return nil, ok, err
+		}
+		val, err := s.codec().Encode(v)
+		return val, err == nil, err
+	}
+
+	var val []byte
+	ok, err := s.get(key, &val)
+
+	return val, ok, err
+}
 
-	stmt, err := s.db.Prepare(q)
+// get scans the value columns for key into dest
+func (s *Storage) get(key string, dest ...interface{}) (bool, error) {
+
+	stmt, done, err := s.stmt(s.getQuery)
 	if err != nil {
-		return nil, false, err
+		return false, err
 	}
-	defer stmt.Close()
+	defer done()
 
-	var val []byte
-	err = stmt.QueryRow(key).Scan(&val)
+	args := []interface{}{key}
+	if s.config.ExpiryColumn != "" {
+		args = append(args, timeNow().Unix())
+	}
+
+	err = stmt.QueryRow(args...).Scan(dest...)
 
 	switch err {
 	case nil:
-		return val, true, nil
+		return true, nil
 	case sql.ErrNoRows:
-		return nil, false, nil
+		return false, nil
 	default:
-		return nil, false, err
+		return false, wrapError(err)
 	}
-
-	panic("not reached")
 }
 
 func (s *Storage) Set(key string, val []byte) error {
+	return s.setBytes(key, val, nil)
+}
+
+// SetWithExpiry sets the value for key, which Get won't return after expires
+func (s *Storage) SetWithExpiry(key string, val []byte, expires time.Time) error {
+
+	if s.config.ExpiryColumn == "" {
+		return ErrNoExpiry
+	}
+
+	return s.setBytes(key, val, expires.Unix())
+}
 
-	// TODO(dgryski): sqlite doesn't have ODKU
-	q := fmt.Sprint("INSERT OR REPLACE INTO ", s.config.Table, " (", s.config.KeyColumn, ",", s.config.ValueColumn, ") VALUES (?, ?)")
+// setBytes stores val, decoding it into the value columns if there are several
+func (s *Storage) setBytes(key string, val []byte, expires interface{}) error {
 
-	stmt, err := s.db.Prepare(q)
+	if len(s.config.ValueColumns) == 0 {
+		return s.set(key, []interface{}{val}, expires)
+	}
+
+	v, err := s.codec().Decode(val)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(key, val)
+	vals, err := s.columnValues(v)
+	if err != nil {
+		return err
+	}
 
-	return err
+	return s.set(key, vals, expires)
 }
 
-func (s *Storage) Delete(key string) (bool, error) {
+// set stores the values of the value columns and the expiry time, which is nil if it doesn't expire
+func (s *Storage) set(key string, vals []interface{}, expires interface{}) error {
+
+	stmt, done, err := s.stmt(s.setQuery)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	args := append([]interface{}{key}, vals...)
+	if s.config.ExpiryColumn != "" {
+		args = append(args, expires)
+	}
+	if s.config.VersionColumn != "" {
+		args = append(args, timeNow().UnixNano())
+	}
+
+	_, err = stmt.Exec(args...)
 
-	q := fmt.Sprint("DELETE FROM ", s.config.Table, " WHERE ", s.config.KeyColumn, "=?")
+	return wrapError(err)
+}
+
+func (s *Storage) Delete(key string) (bool, error) {
 
-	stmt, err := s.db.Prepare(q)
+	stmt, done, err := s.stmt(s.deleteQuery)
 	if err != nil {
 		return false, err
 	}
-	defer stmt.Close()
+	defer done()
 
 	result, err := stmt.Exec(key)
 	if err != nil {
-		return false, err
+		return false, wrapError(err)
 	}
 
 	n, _ := result.RowsAffected()
@@ -106,12 +286,57 @@ func (s *Storage) Delete(key string) (bool, error) {
 	return n == 1, nil
 }
 
+// DeleteExpired deletes the rows whose expiry time has passed, and returns how many there were
+func (s *Storage) DeleteExpired() (int64, error) {
+
+	if s.config.ExpiryColumn == "" {
+		return 0, ErrNoExpiry
+	}
+
+	stmt, done, err := s.stmt(s.expiredQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	result, err := stmt.Exec(timeNow().Unix())
+	if err != nil {
+		return 0, wrapError(err)
+	}
+
+	return result.RowsAffected()
+}
+
+// Ping implements shardedkv.Pinger
+func (s *Storage) Ping() error {
+	db, done := s.conn()
+	defer done()
+	return wrapError(db.Ping())
+}
+
+// ResetConnection reconnects, and prepares the statements again on the new
+// database.  The old database and its statements are closed once the
+// requests already using them have finished.  If reconnecting fails, the old
+// database is kept.
 func (s *Storage) ResetConnection(key string) error {
 
-	s.db.Close()
+	db, err := s.connector()
+	if err != nil {
+		return wrapError(err)
+	}
+
+	s.mu.Lock()
+	old := s.p
+	s.p = &pool{db: db, stmts: make(map[string]*sql.Stmt)}
+	s.mu.Unlock()
 
-	var err error
-	s.db, err = s.connector()
+	go func() {
+		old.users.Wait()
+		for _, stmt := range old.stmts {
+			stmt.Close()
+		}
+		old.db.Close()
+	}()
 
-	return err
+	return nil
 }
@@ -2,6 +2,8 @@ package sql
 
 import (
 	"database/sql"
+	"errors"
+	"github.com/dgryski/go-shardedkv"
 	"github.com/dgryski/go-shardedkv/storagetest"
 	_ "github.com/mattn/go-sqlite3"
 	"io/ioutil"
@@ -55,5 +57,39 @@ value VARCHAR(256) NOT NULL
 
 	storagetest.StorageTest(t, s)
 
+	// the key isn't unique, so Set can't replace a row
+	if err := s.ValidateTable(); !errors.Is(err, ErrSchema) {
+		t.Errorf("ValidateTable without a primary key: got %v, want ErrSchema", err)
+	}
+
+	// statements are prepared again after a reset
+	s.Set("foo", []byte("bar"))
+	if err := s.ResetConnection("foo"); err != nil {
+		t.Errorf("ResetConnection: %v", err)
+	}
+	if v, ok, err := s.Get("foo"); err != nil || !ok || string(v) != "bar" {
+		t.Errorf("Get after reset=(%q,%v,%v)", v, ok, err)
+	}
+
 	os.Remove(f.Name())
 }
+
+func TestDialects(t *testing.T) {
+
+	tests := []struct {
+		d      Dialect
+		upsert string
+	}{
+		{SQLite, "INSERT OR REPLACE INTO kv (k, a, b) VALUES (?, ?, ?)"},
+		{MySQL, "INSERT INTO kv (k, a, b) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE a = VALUES(a), b = VALUES(b)"},
+		{Postgres, "INSERT INTO kv (k, a, b) VALUES ($1, $2, $3) ON CONFLICT (k) DO UPDATE SET a = EXCLUDED.a, b = EXCLUDED.b"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.d.Upsert("kv", "k", []string{"a", "b"}); got != tt.upsert {
+			t.Errorf("%T.Upsert()=%q, want %q", tt.d, got, tt.upsert)
+		}
+	}
+}
+
+var _ shardedkv.Pinger = &Storage{}
@@ -0,0 +1,156 @@
+package sql
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Values maps the names of value columns to their values
+type Values map[string]interface{}
+
+// A Codec converts between the []byte values of the Storage interface and the
+// columns of a table with several value columns
+type Codec interface {
+	Encode(v Values) ([]byte, error)
+	Decode(b []byte) (Values, error)
+}
+
+// JSONCodec encodes the columns as a JSON object.  Byte slices holding valid
+// UTF-8 are encoded as strings, and others as an object {"base64": "..."}, so
+// text stays readable and binary data survives.  Numbers are decoded as
+// int64 if they're integers, and float64 otherwise, so large integers keep
+// their precision.  Integers too large for an int64 are decoded as strings.
+var JSONCodec Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+// base64Key is the only key of the object a binary value is encoded as
+const base64Key = "base64"
+
+func (jsonCodec) Encode(v Values) ([]byte, error) {
+
+	m := make(map[string]interface{}, len(v))
+	for k, val := range v {
+		if b, ok := val.([]byte); ok {
+			if utf8.Valid(b) {
+				val = string(b)
+			} else {
+				val = map[string]string{base64Key: base64.StdEncoding.EncodeToString(b)}
+			}
+		}
+		m[k] = val
+	}
+
+	return json.Marshal(m)
+}
+
+func (jsonCodec) Decode(b []byte) (Values, error) {
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	var v Values
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	for k, val := range v {
+		switch val := val.(type) {
+		case json.Number:
+			v[k] = decodeNumber(val)
+		case map[string]interface{}:
+			if s, ok := val[base64Key].(string); ok && len(val) == 1 {
+				b, err := base64.StdEncoding.DecodeString(s)
+				if err != nil {
+					return nil, fmt.Errorf("sql: column %s: %v", k, err)
+				}
+				v[k] = b
+			}
+		}
+	}
+
+	return v, nil
+}
+
+// decodeNumber returns n as an int64 if it's an integer that fits, a float64 if it isn't an integer, and a string otherwise
+func decodeNumber(n json.Number) interface{} {
+
+	if i, err := n.Int64(); err == nil {
+		return i
+	}
+
+	if strings.ContainsAny(string(n), ".eE") {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+
+	return string(n)
+}
+
+func (s *Storage) codec() Codec {
+	if s.config.Codec == nil {
+		return JSONCodec
+	}
+	return s.config.Codec
+}
+
+// GetValues returns the value columns for key
+func (s *Storage) GetValues(key string) (Values, bool, error) {
+
+	columns := valueColumns(s.config)
+
+	vals := make([]interface{}, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range vals {
+		dest[i] = &vals[i]
+	}
+
+	ok, err := s.get(key, dest...)
+	if !ok || err != nil {
+		return nil, ok, err
+	}
+
+	v := make(Values, len(columns))
+	for i, c := range columns {
+		v[c] = vals[i]
+	}
+
+	return v, true, nil
+}
+
+// SetValues sets the value columns for key.  Columns missing from v are set to NULL.
+func (s *Storage) SetValues(key string, v Values) error {
+
+	vals, err := s.columnValues(v)
+	if err != nil {
+		return err
+	}
+
+	return s.set(key, vals, nil)
+}
+
+// columnValues returns the values in v in column order.  Naming a column the table doesn't have is an ErrSchema error.
+func (s *Storage) columnValues(v Values) ([]interface{}, error) {
+
+	columns := valueColumns(s.config)
+
+	known := make(map[string]bool, len(columns))
+	vals := make([]interface{}, len(columns))
+	for i, c := range columns {
+		known[c] = true
+		vals[i] = v[c]
+	}
+
+	for k := range v {
+		if !known[k] {
+			return nil, fmt.Errorf("%w: %s has no value column %s", ErrSchema, s.config.Table, k)
+		}
+	}
+
+	return vals, nil
+}
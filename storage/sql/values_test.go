@@ -0,0 +1,158 @@
+package sql
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// text returns a column value as a string, whether the driver returned it as a string or []byte
+func text(v interface{}) string {
+	return fmt.Sprintf("%s", v)
+}
+
+func TestValues(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	s, err := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumns: []string{"a", "b", "c"}})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+
+	if err := s.SetValues("foo", Values{"a": "bar", "b": "baz", "c": "qux"}); err != nil {
+		t.Fatalf("SetValues: %v", err)
+	}
+
+	// the columns can be read by other clients of the table
+	var a, b, c string
+	queryRow(s, "SELECT a, b, c FROM kv WHERE k = 'foo'", &a, &b, &c)
+	if a != "bar" || b != "baz" || c != "qux" {
+		t.Errorf("columns=(%q,%q,%q), want (bar,baz,qux)", a, b, c)
+	}
+
+	v, ok, err := s.GetValues("foo")
+	if err != nil || !ok || text(v["a"]) != "bar" || text(v["c"]) != "qux" {
+		t.Errorf("GetValues(foo)=(%v,%v,%v)", v, ok, err)
+	}
+
+	// Get and Set go through the codec
+	val, ok, err := s.Get("foo")
+	if err != nil || !ok {
+		t.Fatalf("Get(foo)=(%q,%v,%v)", val, ok, err)
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(val, &m); err != nil || !reflect.DeepEqual(m, map[string]string{"a": "bar", "b": "baz", "c": "qux"}) {
+		t.Errorf("Get(foo)=%s", val)
+	}
+
+	if err := s.Set("foo", []byte(`{"a":"one","b":"two"}`)); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	v, _, _ = s.GetValues("foo")
+	if text(v["b"]) != "two" || v["c"] != nil {
+		t.Errorf("GetValues after Set=%v, want c to be NULL", v)
+	}
+
+	if err := s.Set("foo", []byte("not json")); err == nil {
+		t.Errorf("Set of a value the codec can't decode succeeded")
+	}
+
+	if err := s.SetValues("foo", Values{"d": "x"}); !errors.Is(err, ErrSchema) {
+		t.Errorf("SetValues of an unknown column: got %v, want ErrSchema", err)
+	}
+
+	if _, ok, err := s.GetValues("missing"); ok || err != nil {
+		t.Errorf("GetValues(missing)=(%v,%v), want (false,nil)", ok, err)
+	}
+}
+
+func TestValuesSingleColumn(t *testing.T) {
+
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	s, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumn: "v"})
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+
+	if err := s.SetValues("foo", Values{"v": []byte("bar")}); err != nil {
+		t.Fatalf("SetValues: %v", err)
+	}
+
+	if val, ok, err := s.Get("foo"); err != nil || !ok || string(val) != "bar" {
+		t.Errorf("Get(foo)=(%q,%v,%v)", val, ok, err)
+	}
+
+	s.Set("foo", []byte("baz"))
+	if v, _, err := s.GetValues("foo"); err != nil || text(v["v"]) != "baz" {
+		t.Errorf("GetValues(foo)=(%v,%v)", v, err)
+	}
+}
+
+func TestJSONCodec(t *testing.T) {
+
+	binary := []byte{0xff, 0xfe, 0x00, 'a', 0x80}
+	big := int64(1<<53 + 1)
+
+	in := Values{"bin": binary, "big": big, "neg": int64(-1 << 62), "f": 1.5, "s": "text", "null": nil}
+
+	b, err := JSONCodec.Encode(in)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	out, err := JSONCodec.Decode(b)
+	if err != nil {
+		t.Fatalf("Decode(%s): %v", b, err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("round trip through %s=%#v, want %#v", b, out, in)
+	}
+
+	// text in a byte slice stays readable
+	if b, _ := JSONCodec.Encode(Values{"a": []byte("bar")}); string(b) != `{"a":"bar"}` {
+		t.Errorf("Encode of text=%s", b)
+	}
+
+	// integers too large for an int64 keep their digits
+	if v, err := JSONCodec.Decode([]byte(`{"a":18446744073709551615}`)); err != nil || v["a"] != "18446744073709551615" {
+		t.Errorf("Decode of a uint64=(%#v,%v)", v, err)
+	}
+
+	// the same values survive a Get and Set through the table
+	connector, cleanup := tempDB(t)
+	defer cleanup()
+
+	s, _ := New(connector, &TableConfig{Table: "kv", KeyColumn: "k", ValueColumns: []string{"bin", "big"}})
+	if err := s.EnsureTable(); err != nil {
+		t.Fatalf("EnsureTable: %v", err)
+	}
+
+	s.SetValues("foo", Values{"bin": binary, "big": big})
+
+	val, _, err := s.Get("foo")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if err := s.Set("bar", val); err != nil {
+		t.Fatalf("Set(%s): %v", val, err)
+	}
+
+	var bin []byte
+	var n int64
+	queryRow(s, "SELECT bin, big FROM kv WHERE k = 'bar'", &bin, &n)
+	if !reflect.DeepEqual(bin, binary) || n != big {
+		t.Errorf("columns after a round trip=(%x,%d), want (%x,%d)", bin, n, binary, big)
+	}
+}
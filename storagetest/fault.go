@@ -0,0 +1,244 @@
+package storagetest
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+)
+
+// ErrInjected is the default error returned by a FaultStore.  It is classified as shardedkv.ErrUnavailable.
+var ErrInjected = shardedkv.NewError(shardedkv.ErrUnavailable, errors.New("storagetest: injected fault"))
+
+// Op is a Storage operation
+type Op int
+
+const (
+	OpGet Op = iota
+	OpSet
+	OpDelete
+	OpResetConnection
+)
+
+// Latency is a latency distribution
+type Latency func(r *rand.Rand) time.Duration
+
+// Constant is a latency distribution that always returns d
+func Constant(d time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration { return d }
+}
+
+// Uniform is a latency distribution uniform over [min, max)
+func Uniform(min, max time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration {
+		if max <= min {
+			return min
+		}
+		return min + time.Duration(r.Int63n(int64(max-min)))
+	}
+}
+
+// Exponential is an exponential latency distribution with the given mean
+func Exponential(mean time.Duration) Latency {
+	return func(r *rand.Rand) time.Duration { return time.Duration(r.ExpFloat64() * float64(mean)) }
+}
+
+// Faults are the faults to inject into an operation
+type Faults struct {
+	// The probability that a call fails
+	ErrorRate float64
+	// The error to fail with.  Default ErrInjected.
+	Err error
+	// The latency added to each call
+	Latency Latency
+	// The probability that a call hangs until Release is called
+	HangRate float64
+	// The probability that a Set writes only part of the value and then fails
+	PartialWriteRate float64
+	// If FlapDown is non-zero, the operation alternates between FlapUp calls which
+	// work normally and FlapDown calls which fail
+	FlapUp   int
+	FlapDown int
+}
+
+// FaultStore wraps a storage and injects faults into its operations.  The
+// faults are chosen from a seeded random number generator, so a sequence of
+// calls made from a single goroutine always sees the same faults.
+type FaultStore struct {
+	Store shardedkv.Storage
+	// Sleep is used to add latency.  Default time.Sleep.
+	Sleep func(time.Duration)
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	faults   map[Op]Faults
+	calls    map[Op]int
+	injected map[Op]int
+	release  chan struct{}
+}
+
+// NewFaultStore returns a FaultStore wrapping store, with no faults configured
+func NewFaultStore(store shardedkv.Storage, seed int64) *FaultStore {
+	return &FaultStore{
+		Store:    store,
+		rnd:      rand.New(rand.NewSource(seed)),
+		faults:   make(map[Op]Faults),
+		calls:    make(map[Op]int),
+		injected: make(map[Op]int),
+		release:  make(chan struct{}),
+	}
+}
+
+// SetFaults sets the faults injected into op
+func (f *FaultStore) SetFaults(op Op, faults Faults) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[op] = faults
+}
+
+// SetAllFaults sets the faults injected into every operation
+func (f *FaultStore) SetAllFaults(faults Faults) {
+	for _, op := range []Op{OpGet, OpSet, OpDelete, OpResetConnection} {
+		f.SetFaults(op, faults)
+	}
+}
+
+// Release unblocks all the calls which are hanging
+func (f *FaultStore) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	close(f.release)
+	f.release = make(chan struct{})
+}
+
+// Injected returns the number of faults injected into op
+func (f *FaultStore) Injected(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected[op]
+}
+
+// fault is the fault chosen for a single call
+type fault struct {
+	err     error
+	latency time.Duration
+	hang    chan struct{}
+	partial int // for a partial write, the number of bytes written
+}
+
+// choose picks the faults for a call to op, which for Set has a value of size n
+func (f *FaultStore) choose(op Op, n int) fault {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	faults := f.faults[op]
+	call := f.calls[op]
+	f.calls[op]++
+
+	errFault := faults.Err
+	if errFault == nil {
+		errFault = ErrInjected
+	}
+
+	var ft fault
+	ft.partial = -1
+
+	// always draw the same random numbers, so one kind of fault doesn't change the sequence for the others
+	errRoll, hangRoll, partialRoll := f.rnd.Float64(), f.rnd.Float64(), f.rnd.Float64()
+	partial := 0
+	if n > 0 {
+		partial = f.rnd.Intn(n)
+	}
+
+	if faults.Latency != nil {
+		ft.latency = faults.Latency(f.rnd)
+	}
+
+	switch {
+	case faults.FlapDown > 0 && call%(faults.FlapUp+faults.FlapDown) >= faults.FlapUp:
+		ft.err = errFault
+	case hangRoll < faults.HangRate:
+		ft.hang = f.release
+	case op == OpSet && partialRoll < faults.PartialWriteRate:
+		ft.err = errFault
+		ft.partial = partial
+	case errRoll < faults.ErrorRate:
+		ft.err = errFault
+	}
+
+	if ft.err != nil || ft.hang != nil {
+		f.injected[op]++
+	}
+
+	return ft
+}
+
+func (f *FaultStore) wait(ft fault) {
+
+	if ft.latency > 0 {
+		sleep := f.Sleep
+		if sleep == nil {
+			sleep = time.Sleep
+		}
+		sleep(ft.latency)
+	}
+
+	if ft.hang != nil {
+		<-ft.hang
+	}
+}
+
+// Get implements Storage.Get()
+func (f *FaultStore) Get(key string) ([]byte, bool, error) {
+
+	ft := f.choose(OpGet, 0)
+	f.wait(ft)
+	if ft.err != nil {
+		return nil, false, ft.err
+	}
+
+	return f.Store.Get(key)
+}
+
+// Set implements Storage.Set()
+func (f *FaultStore) Set(key string, val []byte) error {
+
+	ft := f.choose(OpSet, len(val))
+	f.wait(ft)
+
+	if ft.partial >= 0 {
+		f.Store.Set(key, val[:ft.partial])
+	}
+	if ft.err != nil {
+		return ft.err
+	}
+
+	return f.Store.Set(key, val)
+}
+
+// Delete implements Storage.Delete()
+func (f *FaultStore) Delete(key string) (bool, error) {
+
+	ft := f.choose(OpDelete, 0)
+	f.wait(ft)
+	if ft.err != nil {
+		return false, ft.err
+	}
+
+	return f.Store.Delete(key)
+}
+
+// ResetConnection implements Storage.ResetConnection()
+func (f *FaultStore) ResetConnection(key string) error {
+
+	ft := f.choose(OpResetConnection, 0)
+	f.wait(ft)
+	if ft.err != nil {
+		return ft.err
+	}
+
+	return f.Store.ResetConnection(key)
+}
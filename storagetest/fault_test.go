@@ -0,0 +1,115 @@
+package storagetest
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/dgryski/go-shardedkv"
+	"github.com/dgryski/go-shardedkv/storage/memory"
+)
+
+func TestFaultStore(t *testing.T) {
+	f := NewFaultStore(memory.New(), 1)
+	StorageTest(t, f)
+}
+
+// getErrors returns which of n Gets failed
+func getErrors(f *FaultStore, n int) []bool {
+	var failed []bool
+	for i := 0; i < n; i++ {
+		_, _, err := f.Get("foo")
+		failed = append(failed, err != nil)
+	}
+	return failed
+}
+
+func TestFaultStoreDeterministic(t *testing.T) {
+
+	f1 := NewFaultStore(memory.New(), 42)
+	f1.SetFaults(OpGet, Faults{ErrorRate: 0.3})
+	f2 := NewFaultStore(memory.New(), 42)
+	f2.SetFaults(OpGet, Faults{ErrorRate: 0.3})
+
+	e1, e2 := getErrors(f1, 1000), getErrors(f2, 1000)
+	for i := range e1 {
+		if e1[i] != e2[i] {
+			t.Fatalf("call %d: stores with the same seed differ", i)
+		}
+	}
+
+	if n := f1.Injected(OpGet); n < 200 || n > 400 {
+		t.Errorf("injected %d errors in 1000 calls at rate 0.3", n)
+	}
+
+	_, _, err := NewFaultStore(memory.New(), 1).Get("foo")
+	if err != nil {
+		t.Errorf("Get with no faults failed: %v", err)
+	}
+
+	f1.SetFaults(OpGet, Faults{ErrorRate: 1})
+	if _, _, err := f1.Get("foo"); err != ErrInjected || !errors.Is(err, shardedkv.ErrUnavailable) {
+		t.Errorf("Get()=%v, want ErrInjected", err)
+	}
+}
+
+func TestFaultStoreFlap(t *testing.T) {
+
+	f := NewFaultStore(memory.New(), 1)
+	f.SetFaults(OpGet, Faults{FlapUp: 2, FlapDown: 3})
+
+	want := []bool{false, false, true, true, true, false, false, true}
+	got := getErrors(f, len(want))
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("flapping call %d failed=%v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFaultStorePartialWrite(t *testing.T) {
+
+	m := memory.New()
+	f := NewFaultStore(m, 1)
+	f.SetFaults(OpSet, Faults{PartialWriteRate: 1})
+
+	if err := f.Set("foo", []byte("hello world")); err != ErrInjected {
+		t.Errorf("partial Set()=%v, want ErrInjected", err)
+	}
+
+	val, ok, _ := m.Get("foo")
+	if !ok || len(val) >= len("hello world") || string(val) != "hello world"[:len(val)] {
+		t.Errorf("partial write stored %q, want a prefix of the value", val)
+	}
+}
+
+func TestFaultStoreLatencyAndHang(t *testing.T) {
+
+	f := NewFaultStore(memory.New(), 1)
+	var slept time.Duration
+	f.Sleep = func(d time.Duration) { slept += d }
+
+	f.SetFaults(OpDelete, Faults{Latency: Constant(10 * time.Millisecond)})
+	f.Delete("foo")
+	if slept != 10*time.Millisecond {
+		t.Errorf("slept %v, want 10ms", slept)
+	}
+
+	f.SetFaults(OpGet, Faults{HangRate: 1})
+	done := make(chan struct{})
+	go func() {
+		f.Get("foo")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("hanging Get returned")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	f.Release()
+	<-done
+}
+
+var _ shardedkv.Storage = &FaultStore{}